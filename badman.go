@@ -1,111 +1,532 @@
 package badman
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
 )
 
-// BadMan is Main interface of badman pacakge.
+// BadMan is Main interface of badman pacakge. Methods to access repository, such as Lookup, Download and Refresh, can be called concurrently. Methods to change settings (Set* and ReplaceSerializer) should be called before concurrent use.
 type BadMan struct {
-	repo Repository
-	ser  Serializer
+	repo          atomic.Value // repositoryHolder
+	ser           Serializer
+	domainMatch   DomainMatchMode
+	invalidEntity InvalidEntityHandler
+	syncMode      bool
+	policy        DownloadPolicy
+	signingKey    ed25519.PrivateKey
+	trustedKeys   []ed25519.PublicKey
+}
+
+// InvalidEntityHandler is called when an entity from Source or serialized data is discarded because NormalizeName rejected Name of the entity.
+type InvalidEntityHandler func(entity BadEntity, err error)
+
+// repositoryHolder wraps Repository because atomic.Value requires same concrete type for all values.
+type repositoryHolder struct {
+	Repository
 }
 
 // New is constructor of BadMan
 func New() *BadMan {
-	return &BadMan{
-		repo: NewInMemoryRepository(),
-		ser:  NewGzipMsgpackSerializer(),
+	man := &BadMan{
+		ser: NewGzipMsgpackSerializer(),
 	}
+	man.ReplaceRepository(NewInMemoryRepository())
+	return man
 }
 
-// Insert adds an entity one by one. It's expected to use adding IoC by feed or something like that.
+// repository returns current repository.
+func (x *BadMan) repository() Repository {
+	return x.repo.Load().(repositoryHolder).Repository
+}
+
+// Insert adds an entity one by one. It's expected to use adding IoC by feed or something like that. Name of the entity is normalized by NormalizeName and error is returned if Name is invalid.
 func (x *BadMan) Insert(entity BadEntity) error {
-	return x.repo.Put([]*BadEntity{&entity})
+	return x.InsertContext(context.Background(), entity)
+}
+
+// InsertContext is same with Insert, but it can be cancelled by ctx.
+func (x *BadMan) InsertContext(ctx context.Context, entity BadEntity) error {
+	if err := NormalizeEntity(&entity); err != nil {
+		return errors.Wrap(err, "Fail to insert an invalid entity")
+	}
+	return withContext(x.repository()).PutContext(ctx, []*BadEntity{&entity})
 }
 
 // Lookup searches BadEntity (both of IP address and domain name). If not found, the function returns ([]BadEntity{}, nil). A reason to return list of BadEntity is that multiple blacklists may have same entity.
+// If name is IP address, entities of CIDR and IP address range that contain the address are also returned after exactly matched entities. Entities of network are sorted by longest prefix match.
+// If name is domain name and DomainMatchMode is not MatchExact, entities of parent domains are also returned from the nearest parent. Name of the returned entity indicates which parent domain matched.
+// name is normalized by NormalizeName before searching. If name is invalid, nothing is matched. Expired entities are never returned even if Repository still has them.
 func (x *BadMan) Lookup(name string) ([]BadEntity, error) {
-	return x.repo.Get(name)
+	return x.LookupContext(context.Background(), name)
 }
 
-// Download accesses blacklist data via Sources and store entities that is included in blacklist into repository.
-func (x *BadMan) Download(srcSet []Source) error {
-	msgCh := make(chan *EntityQueue, 128)
-
-	for i := 0; i < len(srcSet); i++ {
-		src := srcSet[i]
-
-		go func() {
-			for msg := range src.Download() {
-				msgCh <- msg
-			}
+// LookupContext is same with Lookup, but it can be cancelled by ctx.
+func (x *BadMan) LookupContext(ctx context.Context, name string) ([]BadEntity, error) {
+	repo := withContext(x.repository())
+	name, err := NormalizeName(name)
+	if err != nil {
+		return nil, nil
+	}
 
-			// Send empty message to notify termination
-			defer func() { msgCh <- &EntityQueue{} }()
-		}()
+	entities, err := repo.GetContext(ctx, name)
+	if err != nil {
+		return nil, err
 	}
 
-	closed := 0
-	for q := range msgCh {
-		if len(q.Entities) == 0 && q.Error == nil {
-			closed++
-			if closed >= len(srcSet) {
-				break
-			}
-			continue
+	switch ClassifyName(name) {
+	case KindIPv4, KindIPv6:
+		networks, err := repo.GetNetworksContext(ctx, net.ParseIP(name))
+		if errors.Cause(err) == ErrNotSupported {
+			break
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "Fail to get networks that contain %s", name)
 		}
+		entities = append(entities, networks...)
 
-		if q.Error != nil {
-			return errors.Wrap(q.Error, "Fail to download from source")
-		}
-		if err := x.repo.Put(q.Entities); err != nil {
-			return errors.Wrapf(err, "Fail to put downloaded entity: %v", q.Entities)
+	case KindDomain:
+		for _, candidate := range domainCandidates(name, x.domainMatch) {
+			parents, err := repo.GetContext(ctx, candidate)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Fail to get parent domain %s of %s", candidate, name)
+			}
+			entities = append(entities, parents...)
 		}
 	}
 
-	return nil
+	return removeExpired(entities, time.Now()), nil
+}
+
+// LookupKind is same with Lookup, but returns only entities of given kinds.
+func (x *BadMan) LookupKind(name string, kinds ...EntityKind) ([]BadEntity, error) {
+	entities, err := x.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []BadEntity
+	for _, entity := range entities {
+		if matchKind(entity.Kind, kinds) {
+			matched = append(matched, entity)
+		}
+	}
+	return matched, nil
 }
 
 // Dump output serialized data into w to save current repository.
 func (x *BadMan) Dump(w io.Writer) error {
-	ch := x.repo.Dump()
+	return x.DumpKindContext(context.Background(), w)
+}
+
+// DumpContext is same with Dump, but it can be cancelled by ctx. Output into w is incomplete if ctx is done.
+func (x *BadMan) DumpContext(ctx context.Context, w io.Writer) error {
+	return x.DumpKindContext(ctx, w)
+}
+
+// DumpKind is same with Dump, but outputs only entities of given kinds. All entities are output if kinds is empty.
+func (x *BadMan) DumpKind(w io.Writer, kinds ...EntityKind) error {
+	return x.DumpKindContext(context.Background(), w, kinds...)
+}
+
+// DumpKindContext is same with DumpKind, but it can be cancelled by ctx.
+func (x *BadMan) DumpKindContext(ctx context.Context, w io.Writer, kinds ...EntityKind) error {
+	return x.dump(ctx, w, nil, kinds)
+}
+
+// DumpDetached is same with Dump, but signature is output into sig instead of embedding it in DumpHeader. SetSigningKey must be called before DumpDetached.
+func (x *BadMan) DumpDetached(w, sig io.Writer) error {
+	return x.DumpDetachedContext(context.Background(), w, sig)
+}
+
+// DumpDetachedContext is same with DumpDetached, but it can be cancelled by ctx.
+func (x *BadMan) DumpDetachedContext(ctx context.Context, w, sig io.Writer) error {
+	if x.signingKey == nil {
+		return errors.New("Fail to dump with detached signature, signing key is not set")
+	}
+	return x.dump(ctx, w, sig, nil)
+}
+
+// dump outputs entities of kinds into w. If sig is not nil, detached signature is output into sig.
+func (x *BadMan) dump(ctx context.Context, w, sig io.Writer, kinds []EntityKind) error {
+	ser, ok := x.ser.(FormatSerializer)
+	if !ok && x.signingKey != nil {
+		return errors.New("Fail to sign dump, Serializer must implement FormatSerializer")
+	}
+
+	// Stop Dump of repository when serialization fails in the middle.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := withContext(x.repository()).DumpContext(ctx)
 	if ch == nil {
 		return fmt.Errorf("This repository does not support Dump()")
 	}
 
-	if err := x.ser.Serialize(ch, w); err != nil {
+	if len(kinds) > 0 {
+		ch = filterKind(ch, kinds)
+	}
+
+	if !ok {
+		// DumpHeader can not describe a custom Serializer, then output only serialized entities.
+		if err := x.ser.Serialize(ch, &contextWriter{ctx: ctx, w: w}); err != nil {
+			return err
+		}
+		// Serialize completes normally when the channel is closed by cancellation.
+		return ctx.Err()
+	}
+
+	return x.dumpWithHeader(ctx, ser, ch, &contextWriter{ctx: ctx, w: w}, sig, nil)
+}
+
+// dumpWithHeader serializes entities into a temporary file at first to count them and calculate the digest, and then outputs DumpHeader and the serialized data into w. DumpHeader is signed if signing key is set. delta is set to DumpHeader if it's not nil, and it can be filled by sender of ch until ch is closed.
+func (x *BadMan) dumpWithHeader(ctx context.Context, ser FormatSerializer, ch chan *EntityQueue, w, sigW io.Writer, delta *DeltaHeader) error {
+	tmp, err := ioutil.TempFile("", "badman-dump-*")
+	if err != nil {
+		drainEntityQueue(ch)
+		return errors.Wrap(err, "Fail to create temporary file for dump")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var count int
+	digest := newDumpDigest()
+	buf := bufio.NewWriter(tmp)
+	counted := countEntityQueue(ch, &count)
+	if err := ser.Serialize(counted, &contextWriter{ctx: ctx, w: io.MultiWriter(buf, digest)}); err != nil {
+		// Serialize may return without reading all messages. Release the sender in background, and the caller should cancel ctx of Dump to stop it early.
+		go drainEntityQueue(counted)
 		return err
 	}
+	// Serialize completes normally when the channel is closed by cancellation.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return errors.Wrap(err, "Fail to write temporary file for dump")
+	}
 
+	header := &DumpHeader{
+		Version:    dumpHeaderVersion,
+		DumpFormat: ser.Format(),
+		CreatedAt:  time.Now().UTC(),
+		Entities:   count,
+		Digest:     dumpDigest(digest),
+		Delta:      delta,
+	}
+	if err := marshalDumpHeader(header); err != nil {
+		return err
+	}
+	if x.signingKey != nil {
+		sig, err := signDumpHeader(header, x.signingKey)
+		if err != nil {
+			return err
+		}
+		if sigW != nil {
+			if err := json.NewEncoder(sigW).Encode(sig); err != nil {
+				return errors.Wrap(err, "Fail to output dump signature")
+			}
+		} else {
+			header.Signature = sig
+		}
+	}
+	if err := writeDumpHeader(w, header); err != nil {
+		return err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "Fail to rewind temporary file for dump")
+	}
+	if _, err := io.Copy(w, tmp); err != nil {
+		return errors.Wrap(err, "Fail to output dump")
+	}
 	return nil
 }
 
-// Load input data that is serialized by Dump(). Please note to use same Serializer for Dump and Load.
+// Load input data that is serialized by Dump(). Serializer is selected by DumpHeader of the data, and current Serializer is used for data without DumpHeader (output by older version or custom Serializer). If trusted keys are set by SetTrustedKeys, Load refuses data that is not signed by one of the keys. If the data is delta by DumpDelta, Load applies it to current repository only when the repository is base of the delta, otherwise it returns an error wrapping ErrDeltaBaseMismatch. Applying delta is not atomic, and an error wrapping ErrDeltaPartiallyApplied means that the repository must be reloaded by a full dump.
 func (x *BadMan) Load(r io.Reader) error {
-	for msg := range x.ser.Deserialize(r) {
+	return x.LoadContext(context.Background(), r)
+}
+
+// LoadContext is same with Load, but it can be cancelled by ctx.
+func (x *BadMan) LoadContext(ctx context.Context, r io.Reader) error {
+	return x.load(ctx, r, nil)
+}
+
+// LoadDetached is same with Load, but signature is read from sig that is output by DumpDetached. SetTrustedKeys must be called before LoadDetached.
+func (x *BadMan) LoadDetached(r, sig io.Reader) error {
+	return x.LoadDetachedContext(context.Background(), r, sig)
+}
+
+// LoadDetachedContext is same with LoadDetached, but it can be cancelled by ctx.
+func (x *BadMan) LoadDetachedContext(ctx context.Context, r, sig io.Reader) error {
+	if len(x.trustedKeys) == 0 {
+		return errors.New("Fail to load with detached signature, trusted keys are not set")
+	}
+	signature, err := ReadDumpSignature(sig)
+	if err != nil {
+		return err
+	}
+	return x.load(ctx, r, signature)
+}
+
+// load puts entities of serialized data in r into repository. If the data has DumpHeader, the body is spooled into a temporary file and verified by signature (if trusted keys are set, embedded one if sig is nil), digest and number of entities before putting any entity. Data without DumpHeader can not be verified and is put while it's read.
+func (x *BadMan) load(ctx context.Context, r io.Reader, sig *DumpSignature) error {
+	br := bufio.NewReader(&contextReader{ctx: ctx, r: r})
+	header, err := readDumpHeader(br)
+	if err != nil {
+		return err
+	}
+
+	ser := x.ser
+	if header != nil {
+		if ser, err = x.serializerOf(header.DumpFormat); err != nil {
+			return err
+		}
+	}
+
+	var body io.Reader = br
+	if len(x.trustedKeys) > 0 {
+		if err := verifyDumpHeader(header, sig, x.trustedKeys); err != nil {
+			return err
+		}
+	}
+	if header != nil {
+		// Entities must not be put until whole data is verified.
+		verified, err := spoolVerifiedBody(br, header.Digest)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(verified.Name())
+		defer verified.Close()
+
+		count, err := countSerialized(ser, verified)
+		if err != nil {
+			return err
+		}
+		if count != header.Entities {
+			return errors.Errorf("Fail to load dump, %d entities are expected but %d entities are found", header.Entities, count)
+		}
+		if _, err := verified.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "Fail to rewind temporary file for load")
+		}
+		body = verified
+	}
+
+	// Delta is applied after whole data is read because it must not be applied partially.
+	var patch *deltaPatch
+	if header != nil && header.Delta != nil {
+		patch = newDeltaPatch(header.Delta, x.normalize)
+	}
+
+	repo := withContext(x.repository())
+	for msg := range ser.Deserialize(body) {
 		if msg.Error != nil {
 			return msg.Error
 		}
 
-		if err := x.repo.Put(msg.Entities); err != nil {
+		if patch != nil {
+			patch.add(msg.Entities)
+			continue
+		}
+		if err := repo.PutContext(ctx, x.normalize(msg.Entities)); err != nil {
 			return err
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if patch != nil {
+		return patch.apply(ctx, x.repository())
+	}
 	return nil
 }
 
+// countSerialized returns number of entities in r that is serialized by ser without putting them.
+func countSerialized(ser Serializer, r io.Reader) (int, error) {
+	var count int
+	for msg := range ser.Deserialize(r) {
+		if msg.Error != nil {
+			return 0, msg.Error
+		}
+		count += len(msg.Entities)
+	}
+	return count, nil
+}
+
+// spoolVerifiedBody copies r into a temporary file and returns the file rewound to the head if digest of r matches expected one. Digest is not checked if expected is empty. Caller must close and remove the file.
+func spoolVerifiedBody(r io.Reader, expected string) (*os.File, error) {
+	tmp, err := ioutil.TempFile("", "badman-load-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to create temporary file for load")
+	}
+
+	digest := newDumpDigest()
+	if _, err := io.Copy(io.MultiWriter(tmp, digest), r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, errors.Wrap(err, "Fail to read dump")
+	}
+	if d := dumpDigest(digest); expected != "" && d != expected {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, errors.Errorf("Fail to verify dump, digest mismatch: expected %s but %s", expected, d)
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, errors.Wrap(err, "Fail to rewind temporary file for load")
+	}
+	return tmp, nil
+}
+
+// drainEntityQueue discards all messages of ch to release the sender.
+func drainEntityQueue(ch chan *EntityQueue) {
+	for range ch {
+	}
+}
+
+// serializerOf returns current Serializer if it has format, otherwise returns a built-in Serializer of format.
+func (x *BadMan) serializerOf(format DumpFormat) (Serializer, error) {
+	if ser, ok := x.ser.(FormatSerializer); ok && ser.Format() == format {
+		return ser, nil
+	}
+	if ser := builtinSerializer(format); ser != nil {
+		return ser, nil
+	}
+	if format.Encryption != "" {
+		return nil, errors.Errorf("Encrypted dump (%s) requires EncryptedSerializer, encoding: %s, compression: %s", format.Encryption, format.Encoding, format.Compression)
+	}
+	return nil, errors.Errorf("Unsupported dump format, encoding: %s, compression: %s", format.Encoding, format.Compression)
+}
+
+// contextReader returns error of ctx when ctx is done to stop Deserialize of Serializer.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (x *contextReader) Read(p []byte) (int, error) {
+	if err := x.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return x.r.Read(p)
+}
+
+// contextWriter returns error of ctx when ctx is done to stop Serialize of Serializer.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (x *contextWriter) Write(p []byte) (int, error) {
+	if err := x.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return x.w.Write(p)
+}
+
+// removeExpired returns entities that are not expired at now.
+func removeExpired(entities []BadEntity, now time.Time) []BadEntity {
+	var alive []BadEntity
+	for _, entity := range entities {
+		if !entity.Expired(now) {
+			alive = append(alive, entity)
+		}
+	}
+	return alive
+}
+
+// filterKind passes only entities of given kinds from ch to returned channel.
+func filterKind(ch chan *EntityQueue, kinds []EntityKind) chan *EntityQueue {
+	filtered := make(chan *EntityQueue)
+	go func() {
+		defer close(filtered)
+		for q := range ch {
+			if q.Error != nil {
+				filtered <- q
+				continue
+			}
+
+			var entities []*BadEntity
+			for _, entity := range q.Entities {
+				if matchKind(entity.Kind, kinds) {
+					entities = append(entities, entity)
+				}
+			}
+			if len(entities) > 0 {
+				filtered <- &EntityQueue{Entities: entities}
+			}
+		}
+	}()
+	return filtered
+}
+
+// normalize normalizes Name of entities and returns only valid entities. Invalid entities are reported to InvalidEntityHandler.
+func (x *BadMan) normalize(entities []*BadEntity) []*BadEntity {
+	valid := make([]*BadEntity, 0, len(entities))
+	for _, entity := range entities {
+		if err := NormalizeEntity(entity); err != nil {
+			if x.invalidEntity != nil {
+				x.invalidEntity(*entity, err)
+			}
+			continue
+		}
+		valid = append(valid, entity)
+	}
+	return valid
+}
+
 // -----------------------------------
 // Utilities
 
-// ReplaceRepository changes Repository to store entities. Entities in old repository are removed.
+// ReplaceRepository changes Repository to store entities. Entities in old repository are removed. The replacement is atomic and safe while other goroutines are looking up.
 func (x *BadMan) ReplaceRepository(repo Repository) {
-	x.repo = repo
+	x.repo.Store(repositoryHolder{repo})
+}
+
+// SetDomainMatchMode changes how Lookup matches a domain name with entities of parent domains. Default is MatchExact.
+func (x *BadMan) SetDomainMatchMode(mode DomainMatchMode) {
+	x.domainMatch = mode
+}
+
+// SetInvalidEntityHandler sets a handler that receives entities discarded by Download and Load because of invalid Name.
+func (x *BadMan) SetInvalidEntityHandler(handler InvalidEntityHandler) {
+	x.invalidEntity = handler
+}
+
+// SetSyncMode enables or disables sync mode of Download. In sync mode, entities that a source no longer publishes are deleted from repository when Download completes successfully.
+func (x *BadMan) SetSyncMode(enabled bool) {
+	x.syncMode = enabled
+}
+
+// SetDownloadPolicy changes behavior of Download when a source fails. Default is FailFast.
+func (x *BadMan) SetDownloadPolicy(policy DownloadPolicy) {
+	x.policy = policy
+}
+
+// SetSigningKey sets ed25519 private key to sign output of Dump. Signing is disabled if key is nil. Serializer must implement FormatSerializer to sign.
+func (x *BadMan) SetSigningKey(key ed25519.PrivateKey) {
+	x.signingKey = key
+}
+
+// SetTrustedKeys sets ed25519 public keys to verify data of Load. If keys are set, Load refuses unsigned data and data that is not signed by one of keys. Verification is disabled if no key is given.
+func (x *BadMan) SetTrustedKeys(keys ...ed25519.PublicKey) {
+	x.trustedKeys = keys
 }
 
 // ReplaceSerializer just changes Serializer with ser.
-func (x BadMan) ReplaceSerializer(ser Serializer) {
+func (x *BadMan) ReplaceSerializer(ser Serializer) {
 	x.ser = ser
 }
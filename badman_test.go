@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/m-mizutani/badman"
@@ -60,6 +61,170 @@ func ExampleBadMan_Insert() {
 	// Output: 10.0.0.1
 }
 
+func ExampleBadEntity_Expired() {
+	man := badman.New()
+
+	if err := man.Insert(badman.BadEntity{
+		Name:      "10.0.0.1",
+		SavedAt:   time.Now(),
+		Src:       "It's me",
+		ExpiresAt: time.Now().Add(-time.Second),
+	}); err != nil {
+		log.Fatal("Fail to insert an entity:", err)
+	}
+
+	entities, err := man.Lookup("10.0.0.1")
+	if err != nil {
+		log.Fatal("Fail to lookup an entity:", err)
+	}
+
+	fmt.Println(len(entities))
+	// Output: 0
+}
+
+func ExampleBadMan_Lookup() {
+	man := badman.New()
+
+	if err := man.Insert(badman.BadEntity{
+		Name:    "192.0.2.0/24",
+		SavedAt: time.Now(),
+		Src:     "It's me",
+	}); err != nil {
+		log.Fatal("Fail to insert an entity:", err)
+	}
+
+	entities, err := man.Lookup("192.0.2.17")
+	if err != nil {
+		log.Fatal("Fail to lookup an entity:", err)
+	}
+
+	fmt.Println(entities[0].Name)
+	// Output: 192.0.2.0/24
+}
+
+func ExampleBadMan_LookupKind() {
+	man := badman.New()
+	man.SetDomainMatchMode(badman.MatchSubdomain)
+
+	for _, name := range []string{"example.com", "blue.example.com"} {
+		if err := man.Insert(badman.BadEntity{
+			Name:    name,
+			SavedAt: time.Now(),
+			Src:     "It's me",
+		}); err != nil {
+			log.Fatal("Fail to insert an entity:", err)
+		}
+	}
+
+	entities, err := man.LookupKind("blue.example.com", badman.KindDomain)
+	if err != nil {
+		log.Fatal("Fail to lookup an entity:", err)
+	}
+
+	fmt.Println(len(entities), entities[0].Kind)
+
+	entities, err = man.LookupKind("blue.example.com", badman.KindIPv4, badman.KindIPv6)
+	if err != nil {
+		log.Fatal("Fail to lookup an entity:", err)
+	}
+
+	fmt.Println(len(entities))
+	// Output:
+	// 2 domain
+	// 0
+}
+
+func ExampleBadMan_SetDomainMatchMode() {
+	man := badman.New()
+	man.SetDomainMatchMode(badman.MatchSubdomain)
+
+	if err := man.Insert(badman.BadEntity{
+		Name:    "evil.example.com",
+		SavedAt: time.Now(),
+		Src:     "It's me",
+	}); err != nil {
+		log.Fatal("Fail to insert an entity:", err)
+	}
+
+	entities, err := man.Lookup("a.b.evil.example.com")
+	if err != nil {
+		log.Fatal("Fail to lookup an entity:", err)
+	}
+
+	fmt.Println(entities[0].Name)
+	// Output: evil.example.com
+}
+
+func ExampleBadMan_SetInvalidEntityHandler() {
+	man := badman.New()
+	man.ReplaceSerializer(badman.NewJSONSerializer())
+	man.SetInvalidEntityHandler(func(entity badman.BadEntity, err error) {
+		fmt.Printf("Discarded %q\n", entity.Name)
+	})
+
+	data := strings.Join([]string{
+		`{"Name":"BLUE.example.com.","Src":"tester"}`,
+		`{"Name":"not a domain","Src":"tester"}`,
+	}, "\n")
+	if err := man.Load(strings.NewReader(data)); err != nil {
+		log.Fatal("Fail to load entities:", err)
+	}
+
+	entities, err := man.Lookup("blue.EXAMPLE.com")
+	if err != nil {
+		log.Fatal("Fail to lookup an entity:", err)
+	}
+
+	fmt.Println(entities[0].Name)
+	// Output:
+	// Discarded "not a domain"
+	// blue.example.com
+}
+
+// listSource is a Source that returns fixed entity names.
+type listSource struct {
+	src   string
+	names []string
+}
+
+func (x *listSource) Download() chan *badman.EntityQueue {
+	ch := make(chan *badman.EntityQueue, 1)
+	var entities []*badman.BadEntity
+	for _, name := range x.names {
+		entities = append(entities, &badman.BadEntity{Name: name, SavedAt: time.Now(), Src: x.src})
+	}
+	ch <- &badman.EntityQueue{Entities: entities}
+	close(ch)
+	return ch
+}
+
+func ExampleBadMan_SetSyncMode() {
+	man := badman.New()
+	man.SetSyncMode(true)
+
+	src := &listSource{src: "feed", names: []string{"blue.example.com", "orange.example.com"}}
+	if err := man.Download([]badman.Source{src}); err != nil {
+		log.Fatal("Fail to download:", err)
+	}
+
+	// orange.example.com is no longer published by the source
+	src.names = []string{"blue.example.com"}
+	if err := man.Download([]badman.Source{src}); err != nil {
+		log.Fatal("Fail to download:", err)
+	}
+
+	for _, name := range []string{"blue.example.com", "orange.example.com"} {
+		entities, err := man.Lookup(name)
+		if err != nil {
+			log.Fatal("Fail to lookup an entity:", err)
+		}
+		fmt.Println(name, len(entities))
+	}
+	// Output:
+	// blue.example.com 1
+	// orange.example.com 0
+}
+
 func ExampleBadMan_Dump() {
 	//SetUp
 	tmp, err := ioutil.TempFile("", "*.dat")
@@ -0,0 +1,395 @@
+package badman
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultBloomCapacity is expected number of names if BloomConfig.Capacity is not set.
+	defaultBloomCapacity = 1000000
+	// defaultBloomFalsePositiveRate is false positive rate if BloomConfig.FalsePositiveRate is not set.
+	defaultBloomFalsePositiveRate = 0.01
+
+	// bloomFormatVersion is version of serialized BloomFilter. It must be incremented when the format or hash functions are changed.
+	bloomFormatVersion = 1
+
+	// bloomMaxBits and bloomMaxHashes are upper limits of m and k of BloomFilter: 32GiB of bits and more hash functions than any meaningful false positive rate needs. ReadBloomFilter rejects larger values.
+	bloomMaxBits   = 1 << 38
+	bloomMaxHashes = 1024
+	// bloomReadChunk is number of words that ReadBloomFilter reads at once. Bits are allocated as they are read, not by m in header.
+	bloomReadChunk = 1 << 17
+)
+
+// bloomMagic is head of serialized BloomFilter.
+var bloomMagic = []byte("BMBF")
+
+// BloomConfig is configuration of NewBloomFilter. Zero value is available.
+type BloomConfig struct {
+	// Capacity is expected number of names and networks that are added. False positive rate increases if more names are added. Default is 1,000,000.
+	Capacity int
+
+	// FalsePositiveRate is expected rate that Test returns true for a name that has not been added. Default is 0.01.
+	FalsePositiveRate float64
+}
+
+// BloomFilter is probabilistic set of names and networks. Test never returns false for a name that has been added, but may return true for a name that has not been added. It's safe for concurrent use.
+type BloomFilter struct {
+	lock  sync.RWMutex
+	bits  []uint64
+	m     uint64 // number of bits
+	k     uint32 // number of hash functions
+	count uint64 // number of added names
+
+	// v4Prefixes and v6Prefixes are sets of prefix length of added networks to test an address against only existing lengths.
+	v4Prefixes [net.IPv4len*8 + 1]bool
+	v6Prefixes [net.IPv6len*8 + 1]bool
+}
+
+// NewBloomFilter is constructor of empty BloomFilter. Size of the filter is decided by config, e.g. about 1.2MB for 1,000,000 names with 0.01 false positive rate.
+func NewBloomFilter(config BloomConfig) *BloomFilter {
+	n := float64(config.Capacity)
+	if n <= 0 {
+		n = defaultBloomCapacity
+	}
+	p := config.FalsePositiveRate
+	if p <= 0 || p >= 1 {
+		p = defaultBloomFalsePositiveRate
+	}
+
+	m := uint64(math.Ceil(-n * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	if m > bloomMaxBits {
+		m = bloomMaxBits
+	}
+	k := uint32(math.Round(float64(m) / n * math.Ln2))
+	if k < 1 {
+		k = 1
+	} else if k > bloomMaxHashes {
+		k = bloomMaxHashes
+	}
+
+	return &BloomFilter{
+		bits: make([]uint64, m/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// BuildBloomFilter creates BloomFilter that has all names of entities in repo by Dump. Capacity of config is used as is, then set it to the number of entities in repo or more.
+func BuildBloomFilter(ctx context.Context, repo Repository, config BloomConfig) (*BloomFilter, error) {
+	ch := withContext(repo).DumpContext(ctx)
+	if ch == nil {
+		return nil, errors.New("Fail to build bloom filter, the repository does not support Dump()")
+	}
+
+	filter := NewBloomFilter(config)
+	for q := range ch {
+		if q.Error != nil {
+			return nil, errors.Wrap(q.Error, "Fail to dump repository for bloom filter")
+		}
+		for _, entity := range q.Entities {
+			filter.Add(entity.Name)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// bloomHash returns two hash values of key for double hashing.
+func bloomHash(key string) (uint64, uint64) {
+	h := fnv.New128a()
+	_, _ = h.Write([]byte(key)) // Write of hash.Hash never returns an error
+	sum := h.Sum(nil)
+	// h2 must be odd not to repeat same bits.
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:]) | 1
+}
+
+// bloomNetworkKey returns key of network in the filter. Names of CIDR and IP address range are stored as networks so that an address in them can be tested.
+func bloomNetworkKey(ip net.IP, ones int) string {
+	return "net:" + (&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, len(ip)*8)}).String()
+}
+
+// Add adds name into the filter. If name is CIDR or IP address range, networks of it are also added for TestAddr.
+func (x *BloomFilter) Add(name string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.add(name)
+	// parseNetworks converts IPv4-mapped IPv6 network to IPv4 one, then it's tested by IPv4 address.
+	for _, network := range parseNetworks(name) {
+		ones, bits := network.Mask.Size()
+		if ip4 := network.IP.To4(); ip4 != nil && bits == net.IPv4len*8 {
+			x.v4Prefixes[ones] = true
+			x.add(bloomNetworkKey(ip4, ones))
+		} else {
+			x.v6Prefixes[ones] = true
+			x.add(bloomNetworkKey(network.IP.To16(), ones))
+		}
+	}
+	x.count++
+}
+
+// add sets bits of key. Caller must hold the lock.
+func (x *BloomFilter) add(key string) {
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < uint64(x.k); i++ {
+		pos := (h1 + i*h2) % x.m
+		x.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+// has returns true if all bits of key are set. Caller must hold the lock.
+func (x *BloomFilter) has(key string) bool {
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < uint64(x.k); i++ {
+		pos := (h1 + i*h2) % x.m
+		if x.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Test returns false if name has never been added. true means name may have been added.
+func (x *BloomFilter) Test(name string) bool {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.has(name)
+}
+
+// TestAddr returns false if no added network contains addr. true means a network that contains addr may have been added.
+func (x *BloomFilter) TestAddr(addr net.IP) bool {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+
+	ip, prefixes := addr.To4(), x.v4Prefixes[:]
+	if ip == nil {
+		ip, prefixes = addr.To16(), x.v6Prefixes[:]
+	}
+	if ip == nil {
+		return false
+	}
+
+	for ones, exists := range prefixes {
+		if exists && x.has(bloomNetworkKey(ip.Mask(net.CIDRMask(ones, len(ip)*8)), ones)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Count returns number of names that have been added, including duplicated ones.
+func (x *BloomFilter) Count() uint64 {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.count
+}
+
+// bloomHeader is fixed size part of serialized BloomFilter after bloomMagic and version.
+type bloomHeader struct {
+	M          uint64
+	K          uint32
+	Count      uint64
+	V4Prefixes [net.IPv4len*8 + 1]bool
+	V6Prefixes [net.IPv6len*8 + 1]bool
+}
+
+// WriteTo writes serialized BloomFilter into w. The format is bloomMagic, version (uint16), bloomHeader and bits in big endian, and it can be read by ReadBloomFilter.
+func (x *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+
+	var buf bytes.Buffer
+	if _, err := buf.Write(bloomMagic); err != nil {
+		return 0, errors.Wrap(err, "Fail to write bloom filter header")
+	}
+	if err := binary.Write(&buf, binary.BigEndian, uint16(bloomFormatVersion)); err != nil {
+		return 0, errors.Wrap(err, "Fail to write bloom filter header")
+	}
+	header := bloomHeader{
+		M:          x.m,
+		K:          x.k,
+		Count:      x.count,
+		V4Prefixes: x.v4Prefixes,
+		V6Prefixes: x.v6Prefixes,
+	}
+	if err := binary.Write(&buf, binary.BigEndian, header); err != nil {
+		return 0, errors.Wrap(err, "Fail to write bloom filter header")
+	}
+
+	n, err := w.Write(buf.Bytes())
+	written := int64(n)
+	if err != nil {
+		return written, errors.Wrap(err, "Fail to write bloom filter header")
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := binary.Write(bw, binary.BigEndian, x.bits); err != nil {
+		return written, errors.Wrap(err, "Fail to write bloom filter")
+	}
+	if err := bw.Flush(); err != nil {
+		return written, errors.Wrap(err, "Fail to write bloom filter")
+	}
+	return written + int64(len(x.bits)*8), nil
+}
+
+// ReadBloomFilter reads BloomFilter that is serialized by WriteTo. Error is returned if the data is not BloomFilter or the version is not supported.
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(bloomMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, errors.Wrap(err, "Fail to read bloom filter magic")
+	}
+	if !bytes.Equal(magic, bloomMagic) {
+		return nil, errors.New("Fail to read bloom filter, invalid magic")
+	}
+
+	var version uint16
+	if err := binary.Read(br, binary.BigEndian, &version); err != nil {
+		return nil, errors.Wrap(err, "Fail to read bloom filter version")
+	}
+	if version != bloomFormatVersion {
+		return nil, errors.Errorf("Fail to read bloom filter, unsupported version: %d", version)
+	}
+
+	var header bloomHeader
+	if err := binary.Read(br, binary.BigEndian, &header); err != nil {
+		return nil, errors.Wrap(err, "Fail to read bloom filter header")
+	}
+	if header.M == 0 || header.M%64 != 0 || header.M > bloomMaxBits || header.K == 0 || header.K > bloomMaxHashes {
+		return nil, errors.Errorf("Fail to read bloom filter, invalid size: m=%d k=%d", header.M, header.K)
+	}
+
+	// Bits are read by chunks not to allocate memory of m in header before the payload is actually read.
+	words := int(header.M / 64)
+	chunk := make([]uint64, bloomReadChunk)
+	if words < len(chunk) {
+		chunk = chunk[:words]
+	}
+	bits := make([]uint64, 0, len(chunk))
+	for len(bits) < words {
+		n := words - len(bits)
+		if n > len(chunk) {
+			n = len(chunk)
+		}
+		if err := binary.Read(br, binary.BigEndian, chunk[:n]); err != nil {
+			return nil, errors.Wrapf(err, "Fail to read bloom filter, payload is shorter than m=%d", header.M)
+		}
+		bits = append(bits, chunk[:n]...)
+	}
+
+	return &BloomFilter{
+		bits:       bits,
+		m:          header.M,
+		k:          header.K,
+		count:      header.Count,
+		v4Prefixes: header.V4Prefixes,
+		v6Prefixes: header.V6Prefixes,
+	}, nil
+}
+
+// bloomRepository is Repository decorator that skips Get and GetNetworks of a backend if BloomFilter tells that nothing matches.
+type bloomRepository struct {
+	repo   RepositoryContext
+	filter *BloomFilter
+}
+
+// NewBloomRepository returns repository that tests names by filter before accessing repo, so that lookups of names that are not in repo do not leave the process. Put via the returned repository adds names into filter. Del and Prune can not remove names from filter, then false positive increases until filter is rebuilt. filter must have all names of repo, otherwise Get may miss entities in repo. Close closes repo if repo implements io.Closer.
+func NewBloomRepository(repo Repository, filter *BloomFilter) Repository {
+	x := &bloomRepository{repo: withContext(repo), filter: filter}
+	if closer, ok := repo.(io.Closer); ok {
+		return &closableBloomRepository{bloomRepository: x, closer: closer}
+	}
+	return x
+}
+
+// closableBloomRepository is bloomRepository of repository that implements io.Closer.
+type closableBloomRepository struct {
+	*bloomRepository
+	closer io.Closer
+}
+
+func (x *closableBloomRepository) Close() error {
+	return x.closer.Close()
+}
+
+func (x *bloomRepository) Put(entities []*BadEntity) error {
+	return x.PutContext(context.Background(), entities)
+}
+
+func (x *bloomRepository) Get(name string) ([]BadEntity, error) {
+	return x.GetContext(context.Background(), name)
+}
+
+func (x *bloomRepository) GetNetworks(addr net.IP) ([]BadEntity, error) {
+	return x.GetNetworksContext(context.Background(), addr)
+}
+
+func (x *bloomRepository) Del(name string) error {
+	return x.DelContext(context.Background(), name)
+}
+
+func (x *bloomRepository) Prune(src string, before time.Time) error {
+	return x.PruneContext(context.Background(), src, before)
+}
+
+func (x *bloomRepository) Dump() chan *EntityQueue {
+	return x.DumpContext(context.Background())
+}
+
+func (x *bloomRepository) PutContext(ctx context.Context, entities []*BadEntity) error {
+	// Add names before Put so that concurrent Get does not miss stored entities.
+	for _, entity := range entities {
+		x.filter.Add(entity.Name)
+	}
+	return x.repo.PutContext(ctx, entities)
+}
+
+func (x *bloomRepository) GetContext(ctx context.Context, name string) ([]BadEntity, error) {
+	if !x.filter.Test(name) {
+		return nil, nil
+	}
+	return x.repo.GetContext(ctx, name)
+}
+
+func (x *bloomRepository) GetNetworksContext(ctx context.Context, addr net.IP) ([]BadEntity, error) {
+	if !x.filter.TestAddr(addr) {
+		return nil, nil
+	}
+	return x.repo.GetNetworksContext(ctx, addr)
+}
+
+func (x *bloomRepository) DelContext(ctx context.Context, name string) error {
+	return x.repo.DelContext(ctx, name)
+}
+
+func (x *bloomRepository) PruneContext(ctx context.Context, src string, before time.Time) error {
+	return x.repo.PruneContext(ctx, src, before)
+}
+
+func (x *bloomRepository) DumpContext(ctx context.Context) chan *EntityQueue {
+	return x.repo.DumpContext(ctx)
+}
+
+func (x *bloomRepository) Count(ctx context.Context, filter EntityFilter) (*RepositoryStats, error) {
+	return withStats(x.repo).Count(ctx, filter)
+}
+
+func (x *bloomRepository) Iterate(ctx context.Context, filter EntityFilter) chan *EntityQueue {
+	return withStats(x.repo).Iterate(ctx, filter)
+}
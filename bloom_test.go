@@ -0,0 +1,165 @@
+package badman_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/badman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter(t *testing.T) {
+	filter := badman.NewBloomFilter(badman.BloomConfig{Capacity: 1000, FalsePositiveRate: 0.01})
+	for i := 0; i < 1000; i++ {
+		filter.Add(fmt.Sprintf("%d.example.com", i))
+	}
+	assert.Equal(t, uint64(1000), filter.Count())
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, filter.Test(fmt.Sprintf("%d.example.com", i)))
+	}
+
+	var fp int
+	for i := 0; i < 10000; i++ {
+		if filter.Test(fmt.Sprintf("%d.example.org", i)) {
+			fp++
+		}
+	}
+	assert.True(t, fp < 300, "too many false positives: %d", fp)
+}
+
+func TestBloomFilterAddr(t *testing.T) {
+	filter := badman.NewBloomFilter(badman.BloomConfig{Capacity: 100})
+	filter.Add("192.0.2.0/24")
+	filter.Add("198.51.100.1-198.51.100.20")
+	filter.Add("2001:db8::/32")
+
+	assert.True(t, filter.TestAddr(net.ParseIP("192.0.2.1")))
+	assert.True(t, filter.TestAddr(net.ParseIP("198.51.100.16")))
+	assert.True(t, filter.TestAddr(net.ParseIP("2001:db8::1")))
+	assert.False(t, filter.TestAddr(net.ParseIP("203.0.113.1")))
+	assert.False(t, filter.TestAddr(net.ParseIP("2001:db9::1")))
+
+	// IPv4-mapped IPv6 network is tested by IPv4 address.
+	filter.Add("::ffff:203.0.113.0/120")
+	assert.True(t, filter.TestAddr(net.ParseIP("203.0.113.1")))
+	assert.True(t, filter.TestAddr(net.ParseIP("::ffff:203.0.113.1")))
+}
+
+func TestBloomFilterSerialize(t *testing.T) {
+	filter := badman.NewBloomFilter(badman.BloomConfig{Capacity: 100})
+	filter.Add("blue.example.com")
+	filter.Add("192.0.2.0/24")
+
+	var buf bytes.Buffer
+	n, err := filter.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	loaded, err := badman.ReadBloomFilter(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), loaded.Count())
+	assert.True(t, loaded.Test("blue.example.com"))
+	assert.False(t, loaded.Test("orange.example.com"))
+	assert.True(t, loaded.TestAddr(net.ParseIP("192.0.2.1")))
+
+	// Broken header and payload: m is at offset 6 and k is at offset 14.
+	broken := func(f func(data []byte) []byte) error {
+		_, err := badman.ReadBloomFilter(bytes.NewReader(f(append([]byte{}, buf.Bytes()...))))
+		return err
+	}
+	assert.Error(t, broken(func(data []byte) []byte {
+		binary.BigEndian.PutUint64(data[6:], 1<<40)
+		return data
+	}), "too large m")
+	assert.Error(t, broken(func(data []byte) []byte {
+		// m is acceptable but the payload is much shorter. It must fail without allocating 16GiB.
+		binary.BigEndian.PutUint64(data[6:], 1<<37)
+		return data
+	}), "payload shorter than m")
+	assert.Error(t, broken(func(data []byte) []byte {
+		binary.BigEndian.PutUint32(data[14:], 1<<20)
+		return data
+	}), "too large k")
+	assert.Error(t, broken(func(data []byte) []byte {
+		return data[:len(data)-1]
+	}), "truncated payload")
+
+	// Unsupported version
+	data := buf.Bytes()
+	data[5] = 99
+	_, err = badman.ReadBloomFilter(bytes.NewReader(data))
+	assert.Error(t, err)
+
+	// Not bloom filter
+	_, err = badman.ReadBloomFilter(bytes.NewReader([]byte("not a bloom filter")))
+	assert.Error(t, err)
+}
+
+func TestBuildBloomFilter(t *testing.T) {
+	repo := badman.NewInMemoryRepository()
+	putTestEntities(t, repo, 100)
+
+	filter, err := badman.BuildBloomFilter(context.Background(), repo, badman.BloomConfig{Capacity: 100})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), filter.Count())
+	assert.True(t, filter.Test("42.example.com"))
+}
+
+// countingRepository counts calls of Get and GetNetworks.
+type countingRepository struct {
+	badman.Repository
+	gets int
+}
+
+func (x *countingRepository) Get(name string) ([]badman.BadEntity, error) {
+	x.gets++
+	return x.Repository.Get(name)
+}
+
+func (x *countingRepository) GetNetworks(addr net.IP) ([]badman.BadEntity, error) {
+	x.gets++
+	return x.Repository.GetNetworks(addr)
+}
+
+func TestBloomRepository(t *testing.T) {
+	filter := badman.NewBloomFilter(badman.BloomConfig{Capacity: 1000})
+	repo := badman.NewBloomRepository(badman.NewInMemoryRepository(), filter)
+	repositoryCommonTest(repo, t)
+	repositoryNetworkTest(repo, t)
+	repositorySightingTest(repo, t)
+}
+
+func TestBloomRepositoryPrefilter(t *testing.T) {
+	backend := &countingRepository{Repository: badman.NewInMemoryRepository()}
+	filter := badman.NewBloomFilter(badman.BloomConfig{Capacity: 1000})
+	repo := badman.NewBloomRepository(backend, filter)
+
+	require.NoError(t, repo.Put([]*badman.BadEntity{
+		{Name: "blue.example.com", SavedAt: time.Now(), Src: "tester"},
+		{Name: "192.0.2.0/24", SavedAt: time.Now(), Src: "tester"},
+	}))
+
+	entities, err := repo.Get("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+	networks, err := repo.GetNetworks(net.ParseIP("192.0.2.1"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(networks))
+	assert.Equal(t, 2, backend.gets)
+
+	// Negative lookups do not reach backend.
+	entities, err = repo.Get("orange.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entities))
+	networks, err = repo.GetNetworks(net.ParseIP("203.0.113.1"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(networks))
+	assert.Equal(t, 2, backend.gets)
+}
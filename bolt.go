@@ -0,0 +1,422 @@
+package badman
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v4"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// boltEntityBucket has entities. Key is name + boltKeySep + src and value is msgpack encoded BadEntity.
+	boltEntityBucket = []byte("entities")
+	// boltSourceBucket is index of src. Key is src + boltKeySep + name and value is empty.
+	boltSourceBucket = []byte("sources")
+	// boltNetworkBucket is index of networks. Key is boltNetworkPrefix + name and value is empty.
+	boltNetworkBucket = []byte("networks")
+)
+
+const (
+	// boltKeySep separates fields of a key. Names and srcs never contain NUL.
+	boltKeySep = 0x00
+	// boltDumpChunkSize is number of keys that are read in one transaction by Dump.
+	boltDumpChunkSize = 1000
+)
+
+// boltRepository is on-disk type repository by bbolt (https://github.com/etcd-io/bbolt). It's safe for concurrent use, and entities persist over restart of a process. Entities are not loaded into memory except entities that are accessed.
+type boltRepository struct {
+	db *bolt.DB
+}
+
+// NewBoltRepository is constructor of boltRepository. The database file is created at path if it does not exist. Only one process can open the file at the same time, and Close should be called when the repository is no longer used.
+func NewBoltRepository(path string) (Repository, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to open bolt DB: %s", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltEntityBucket, boltSourceBucket, boltNetworkBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return errors.Wrapf(err, "Fail to create bucket: %s", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltRepository{db: db}, nil
+}
+
+// Close closes the database file.
+func (x *boltRepository) Close() error {
+	if err := x.db.Close(); err != nil {
+		return errors.Wrap(err, "Fail to close bolt DB")
+	}
+	return nil
+}
+
+func boltKey(a, b string) []byte {
+	key := make([]byte, 0, len(a)+len(b)+1)
+	key = append(key, a...)
+	key = append(key, boltKeySep)
+	return append(key, b...)
+}
+
+func boltPrefix(a string) []byte {
+	return append([]byte(a), boltKeySep)
+}
+
+// boltNetworkPrefix returns prefix of network key: address length (4 or 16), prefix length and network address.
+func boltNetworkPrefix(ip net.IP, ones int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ip = ip.To16()
+	}
+	masked := ip.Mask(net.CIDRMask(ones, len(ip)*8))
+
+	prefix := make([]byte, 0, len(masked)+2)
+	prefix = append(prefix, byte(len(masked)), byte(ones))
+	return append(prefix, masked...)
+}
+
+func boltNetworkKeys(name string) [][]byte {
+	var keys [][]byte
+	for _, network := range parseNetworks(name) {
+		ones, _ := network.Mask.Size()
+		keys = append(keys, append(boltNetworkPrefix(network.IP, ones), name...))
+	}
+	return keys
+}
+
+func (x *boltRepository) Put(entities []*BadEntity) error {
+	now := time.Now()
+
+	err := x.db.Update(func(tx *bolt.Tx) error {
+		entityBucket := tx.Bucket(boltEntityBucket)
+		srcBucket := tx.Bucket(boltSourceBucket)
+		netBucket := tx.Bucket(boltNetworkBucket)
+
+		for _, e := range entities {
+			key := boltKey(e.Name, e.Src)
+			entity := sighted(*e, now)
+
+			if raw := entityBucket.Get(key); raw != nil {
+				var old BadEntity
+				if err := msgpack.Unmarshal(raw, &old); err != nil {
+					return errors.Wrapf(err, "Fail to decode entity: %s", key)
+				}
+				if !old.Expired(now) {
+					entity = mergeSighting(old, entity, isFreshSighting(e))
+				}
+			}
+
+			raw, err := msgpack.Marshal(&entity)
+			if err != nil {
+				return errors.Wrapf(err, "Fail to encode entity: %v", entity)
+			}
+			if err := entityBucket.Put(key, raw); err != nil {
+				return errors.Wrapf(err, "Fail to put entity: %v", entity)
+			}
+			if err := srcBucket.Put(boltKey(e.Src, e.Name), nil); err != nil {
+				return errors.Wrapf(err, "Fail to put src index: %v", entity)
+			}
+			for _, netKey := range boltNetworkKeys(e.Name) {
+				if err := netBucket.Put(netKey, nil); err != nil {
+					return errors.Wrapf(err, "Fail to put network index: %v", entity)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (x *boltRepository) Get(name string) ([]BadEntity, error) {
+	var entities []BadEntity
+	err := x.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entities, err = boltGet(tx, name, time.Now())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+// boltGet returns entities of name that are not expired at now.
+func boltGet(tx *bolt.Tx, name string, now time.Time) ([]BadEntity, error) {
+	var entities []BadEntity
+	prefix := boltPrefix(name)
+	c := tx.Bucket(boltEntityBucket).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var entity BadEntity
+		if err := msgpack.Unmarshal(v, &entity); err != nil {
+			return nil, errors.Wrapf(err, "Fail to decode entity: %s", k)
+		}
+		if !entity.Expired(now) {
+			entities = append(entities, entity)
+		}
+	}
+
+	return entities, nil
+}
+
+func (x *boltRepository) GetNetworks(addr net.IP) ([]BadEntity, error) {
+	bits := len(addr.To16()) * 8
+	if addr.To4() != nil {
+		bits = 32
+	}
+	if bits == 0 {
+		return nil, nil
+	}
+
+	var entities []BadEntity
+	err := x.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		c := tx.Bucket(boltNetworkBucket).Cursor()
+		seen := map[string]struct{}{}
+
+		// Look up from the longest prefix to return entities of longer prefix first.
+		for ones := bits; ones >= 0; ones-- {
+			prefix := boltNetworkPrefix(addr, ones)
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				name := string(k[len(prefix):])
+				if _, ok := seen[name]; ok {
+					continue
+				}
+				seen[name] = struct{}{}
+
+				matched, err := boltGet(tx, name, now)
+				if err != nil {
+					return err
+				}
+				entities = append(entities, matched...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (x *boltRepository) Del(name string) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		prefix := boltPrefix(name)
+		var srcs []string
+		c := tx.Bucket(boltEntityBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			srcs = append(srcs, string(k[len(prefix):]))
+		}
+
+		for _, src := range srcs {
+			if err := boltDelete(tx, name, src); err != nil {
+				return err
+			}
+		}
+
+		return boltDeleteNetworks(tx, name)
+	})
+}
+
+// boltDelete deletes an entity and src index of it.
+func boltDelete(tx *bolt.Tx, name, src string) error {
+	if err := tx.Bucket(boltEntityBucket).Delete(boltKey(name, src)); err != nil {
+		return errors.Wrapf(err, "Fail to delete entity: %s %s", name, src)
+	}
+	if err := tx.Bucket(boltSourceBucket).Delete(boltKey(src, name)); err != nil {
+		return errors.Wrapf(err, "Fail to delete src index: %s %s", name, src)
+	}
+	return nil
+}
+
+// boltDeleteNetworks deletes network index of name.
+func boltDeleteNetworks(tx *bolt.Tx, name string) error {
+	for _, netKey := range boltNetworkKeys(name) {
+		if err := tx.Bucket(boltNetworkBucket).Delete(netKey); err != nil {
+			return errors.Wrapf(err, "Fail to delete network index: %s", name)
+		}
+	}
+	return nil
+}
+
+func (x *boltRepository) Prune(src string, before time.Time) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		prefix := boltPrefix(src)
+		entityBucket := tx.Bucket(boltEntityBucket)
+
+		// Keys are collected before deletion because deleting while iterating a cursor may skip keys.
+		var names []string
+		c := tx.Bucket(boltSourceBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			name := string(k[len(prefix):])
+			raw := entityBucket.Get(boltKey(name, src))
+			if raw == nil {
+				names = append(names, name)
+				continue
+			}
+
+			var entity BadEntity
+			if err := msgpack.Unmarshal(raw, &entity); err != nil {
+				return errors.Wrapf(err, "Fail to decode entity: %s %s", name, src)
+			}
+			if entity.LastSeen.Before(before) {
+				names = append(names, name)
+			}
+		}
+
+		for _, name := range names {
+			if err := boltDelete(tx, name, src); err != nil {
+				return err
+			}
+
+			if k, _ := entityBucket.Cursor().Seek(boltPrefix(name)); k == nil || !bytes.HasPrefix(k, boltPrefix(name)) {
+				if err := boltDeleteNetworks(tx, name); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func (x *boltRepository) Dump() chan *EntityQueue {
+	return x.DumpContext(context.Background())
+}
+
+func (x *boltRepository) PutContext(ctx context.Context, entities []*BadEntity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return x.Put(entities)
+}
+
+func (x *boltRepository) GetContext(ctx context.Context, name string) ([]BadEntity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return x.Get(name)
+}
+
+func (x *boltRepository) GetNetworksContext(ctx context.Context, addr net.IP) ([]BadEntity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return x.GetNetworks(addr)
+}
+
+func (x *boltRepository) DelContext(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return x.Del(name)
+}
+
+func (x *boltRepository) PruneContext(ctx context.Context, src string, before time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return x.Prune(src, before)
+}
+
+func (x *boltRepository) DumpContext(ctx context.Context) chan *EntityQueue {
+	ch := make(chan *EntityQueue)
+	go func() {
+		defer close(ch)
+
+		// Entities are read by chunk in separated transactions not to keep a read transaction while a receiver is working. A long read transaction prevents bbolt from reusing pages.
+		var next []byte
+		for {
+			queues, last, err := x.dumpChunk(next, time.Now())
+			if err != nil {
+				queues = append(queues, &EntityQueue{Error: err})
+			}
+
+			for _, q := range queues {
+				select {
+				case ch <- q:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if err != nil || last == nil {
+				return
+			}
+			next = last
+		}
+	}()
+	return ch
+}
+
+// dumpChunk reads entities of up to boltDumpChunkSize keys after the key of after. One EntityQueue has entities of one name. Returned key is the last key that has been read, and it's nil if no more keys remain.
+func (x *boltRepository) dumpChunk(after []byte, now time.Time) ([]*EntityQueue, []byte, error) {
+	var queues []*EntityQueue
+	var last []byte
+
+	err := x.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltEntityBucket).Cursor()
+		k, v := c.First()
+		if after != nil {
+			k, v = c.Seek(after)
+			if bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+		}
+
+		var q *EntityQueue
+		var name []byte
+		for i := 0; k != nil; i++ {
+			// Stop at boundary of names to keep entities of one name in one EntityQueue.
+			n := k[:bytes.IndexByte(k, boltKeySep)]
+			if i >= boltDumpChunkSize && !bytes.Equal(n, name) {
+				break
+			}
+
+			var entity BadEntity
+			if err := msgpack.Unmarshal(v, &entity); err != nil {
+				return errors.Wrapf(err, "Fail to decode entity: %s", k)
+			}
+
+			if q == nil || !bytes.Equal(n, name) {
+				q = &EntityQueue{}
+				queues = append(queues, q)
+				name = append(name[:0], n...)
+			}
+			if !entity.Expired(now) {
+				q.Entities = append(q.Entities, &entity)
+			}
+			last = append(last[:0], k...)
+			k, v = c.Next()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Remove queues that have only expired entities.
+	var results []*EntityQueue
+	for _, q := range queues {
+		if len(q.Entities) > 0 {
+			results = append(results, q)
+		}
+	}
+	return results, last, nil
+}
@@ -0,0 +1,317 @@
+package badman
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCacheSize is max number of cached results if CacheConfig.Size is not set.
+	defaultCacheSize = 10000
+	// defaultCacheTTL is lifetime of a cached result if CacheConfig.TTL is not set.
+	defaultCacheTTL = 5 * time.Minute
+)
+
+// CacheConfig is configuration of NewCachedRepository. Zero value is available.
+type CacheConfig struct {
+	// Size is max number of cached results of Get and GetNetworks. The least recently used result is evicted when cache is full. Default is 10000.
+	Size int
+
+	// TTL is lifetime of a cached result that has entities. Default is 5 minutes. Lifetime is shortened to the earliest ExpiresAt of the entities.
+	TTL time.Duration
+
+	// NegativeTTL is lifetime of a cached result that has no entity. Default is same with TTL.
+	NegativeTTL time.Duration
+}
+
+// CacheStats is statistics of cached repository.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Entries is number of results that are cached currently, including expired ones that are not evicted yet.
+	Entries int
+}
+
+// HitRate returns ratio of hits to all Get and GetNetworks calls. 0 is returned if nothing has been called.
+func (x CacheStats) HitRate() float64 {
+	total := x.Hits + x.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(x.Hits) / float64(total)
+}
+
+// CachedRepository is Repository with read-through cache that is created by NewCachedRepository.
+type CachedRepository interface {
+	RepositoryContext
+	// Stats returns statistics of the cache.
+	Stats() CacheStats
+	// Purge removes all cached results.
+	Purge()
+}
+
+// cachedRepository is Repository wrapper that caches results of Get and GetNetworks by LRU. It's safe for concurrent use.
+type cachedRepository struct {
+	repo        RepositoryContext
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+	stats   CacheStats
+	// version is incremented by every write to discard results that are fetched from repo during the write.
+	version uint64
+	// netGen is incremented when a network entity is changed because it affects cached results of any address.
+	netGen uint64
+}
+
+type cacheEntry struct {
+	key       string
+	entities  []BadEntity
+	expiresAt time.Time
+	netGen    uint64
+}
+
+// NewCachedRepository returns repository that caches results of Get and GetNetworks of repo in memory, including empty results. Cached results are invalidated by Put, Del and Prune via the returned repository, but changes of repo by others are not visible until TTL of cached results expires. Put, Del, Prune and Dump are passed to repo as is. Close closes repo if repo implements io.Closer.
+func NewCachedRepository(repo Repository, config CacheConfig) CachedRepository {
+	x := &cachedRepository{
+		repo:        withContext(repo),
+		size:        config.Size,
+		ttl:         config.TTL,
+		negativeTTL: config.NegativeTTL,
+		now:         time.Now,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+	if x.size <= 0 {
+		x.size = defaultCacheSize
+	}
+	if x.ttl <= 0 {
+		x.ttl = defaultCacheTTL
+	}
+	if x.negativeTTL <= 0 {
+		x.negativeTTL = x.ttl
+	}
+
+	if closer, ok := repo.(io.Closer); ok {
+		return &closableCachedRepository{cachedRepository: x, closer: closer}
+	}
+	return x
+}
+
+// closableCachedRepository is cachedRepository of repository that implements io.Closer.
+type closableCachedRepository struct {
+	*cachedRepository
+	closer io.Closer
+}
+
+func (x *closableCachedRepository) Close() error {
+	return x.closer.Close()
+}
+
+// lookup returns cached result of key. ok is false if key is not cached or the result is stale. version at the time is also returned to store a fetched result later.
+func (x *cachedRepository) lookup(key string, network bool) (entities []BadEntity, ok bool, version uint64) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	elem, found := x.entries[key]
+	if found {
+		entry := elem.Value.(*cacheEntry)
+		if x.now().Before(entry.expiresAt) && (!network || entry.netGen == x.netGen) {
+			x.lru.MoveToFront(elem)
+			x.stats.Hits++
+			return copyEntities(entry.entities), true, x.version
+		}
+		x.remove(elem)
+	}
+
+	x.stats.Misses++
+	return nil, false, x.version
+}
+
+// store caches entities as result of key unless a write happened after version.
+func (x *cachedRepository) store(key string, entities []BadEntity, version uint64) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	if version != x.version {
+		return
+	}
+
+	ttl := x.ttl
+	if len(entities) == 0 {
+		ttl = x.negativeTTL
+	}
+	entry := &cacheEntry{
+		key:       key,
+		entities:  copyEntities(entities),
+		expiresAt: x.now().Add(ttl),
+		netGen:    x.netGen,
+	}
+	// The result becomes stale when an entity in it expires not to return the expired entity.
+	for _, entity := range entities {
+		if !entity.ExpiresAt.IsZero() && entity.ExpiresAt.Before(entry.expiresAt) {
+			entry.expiresAt = entity.ExpiresAt
+		}
+	}
+
+	if elem, found := x.entries[key]; found {
+		elem.Value = entry
+		x.lru.MoveToFront(elem)
+		return
+	}
+
+	x.entries[key] = x.lru.PushFront(entry)
+	for x.lru.Len() > x.size {
+		x.remove(x.lru.Back())
+		x.stats.Evictions++
+	}
+}
+
+// remove deletes elem from cache. Caller must hold the lock.
+func (x *cachedRepository) remove(elem *list.Element) {
+	x.lru.Remove(elem)
+	delete(x.entries, elem.Value.(*cacheEntry).key)
+}
+
+// invalidate removes cached results of names. Cached results of all addresses are also invalidated if names have a network.
+func (x *cachedRepository) invalidate(names []string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.version++
+	for _, name := range names {
+		if elem, found := x.entries[cacheNameKey(name)]; found {
+			x.remove(elem)
+		}
+		if ClassifyName(name) == KindCIDR {
+			x.netGen++
+		}
+	}
+}
+
+func (x *cachedRepository) Stats() CacheStats {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	stats := x.stats
+	stats.Entries = x.lru.Len()
+	return stats
+}
+
+func (x *cachedRepository) Purge() {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.version++
+	x.entries = make(map[string]*list.Element)
+	x.lru.Init()
+}
+
+// cacheNameKey and cacheAddrKey separate keys of Get and GetNetworks.
+func cacheNameKey(name string) string { return "n:" + name }
+func cacheAddrKey(addr net.IP) string { return "a:" + addr.String() }
+
+// copyEntities returns copy of entities so that a caller can not modify cached result via returned slice.
+func copyEntities(entities []BadEntity) []BadEntity {
+	if entities == nil {
+		return nil
+	}
+	return append([]BadEntity{}, entities...)
+}
+
+func (x *cachedRepository) Put(entities []*BadEntity) error {
+	return x.PutContext(context.Background(), entities)
+}
+
+func (x *cachedRepository) Get(name string) ([]BadEntity, error) {
+	return x.GetContext(context.Background(), name)
+}
+
+func (x *cachedRepository) GetNetworks(addr net.IP) ([]BadEntity, error) {
+	return x.GetNetworksContext(context.Background(), addr)
+}
+
+func (x *cachedRepository) Del(name string) error {
+	return x.DelContext(context.Background(), name)
+}
+
+func (x *cachedRepository) Prune(src string, before time.Time) error {
+	return x.PruneContext(context.Background(), src, before)
+}
+
+func (x *cachedRepository) Dump() chan *EntityQueue {
+	return x.DumpContext(context.Background())
+}
+
+func (x *cachedRepository) PutContext(ctx context.Context, entities []*BadEntity) error {
+	names := make([]string, len(entities))
+	for i, entity := range entities {
+		names[i] = entity.Name
+	}
+
+	// Invalidate even if Put fails because some entities may be stored.
+	defer x.invalidate(names)
+	return x.repo.PutContext(ctx, entities)
+}
+
+func (x *cachedRepository) GetContext(ctx context.Context, name string) ([]BadEntity, error) {
+	key := cacheNameKey(name)
+	entities, ok, version := x.lookup(key, false)
+	if ok {
+		return entities, nil
+	}
+
+	entities, err := x.repo.GetContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	x.store(key, entities, version)
+	return entities, nil
+}
+
+func (x *cachedRepository) GetNetworksContext(ctx context.Context, addr net.IP) ([]BadEntity, error) {
+	key := cacheAddrKey(addr)
+	entities, ok, version := x.lookup(key, true)
+	if ok {
+		return entities, nil
+	}
+
+	entities, err := x.repo.GetNetworksContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	x.store(key, entities, version)
+	return entities, nil
+}
+
+func (x *cachedRepository) DelContext(ctx context.Context, name string) error {
+	defer x.invalidate([]string{name})
+	return x.repo.DelContext(ctx, name)
+}
+
+func (x *cachedRepository) PruneContext(ctx context.Context, src string, before time.Time) error {
+	// Pruned names are unknown, then all cached results are discarded.
+	defer x.Purge()
+	return x.repo.PruneContext(ctx, src, before)
+}
+
+func (x *cachedRepository) DumpContext(ctx context.Context) chan *EntityQueue {
+	return x.repo.DumpContext(ctx)
+}
+
+func (x *cachedRepository) Count(ctx context.Context, filter EntityFilter) (*RepositoryStats, error) {
+	return withStats(x.repo).Count(ctx, filter)
+}
+
+func (x *cachedRepository) Iterate(ctx context.Context, filter EntityFilter) chan *EntityQueue {
+	return withStats(x.repo).Iterate(ctx, filter)
+}
@@ -0,0 +1,159 @@
+package badman_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/badman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedRepository(t *testing.T) {
+	repo := badman.NewCachedRepository(badman.NewInMemoryRepository(), badman.CacheConfig{})
+	repositoryCommonTest(repo, t)
+	repositoryNetworkTest(repo, t)
+	repositoryExpirationTest(repo, t)
+	repositorySightingTest(repo, t)
+	repositoryPruneTest(repo, t)
+}
+
+func TestCachedRepositoryConcurrency(t *testing.T) {
+	repo := badman.NewCachedRepository(badman.NewInMemoryRepository(), badman.CacheConfig{Size: 10})
+	repositoryConcurrencyTest(repo, t)
+}
+
+func TestCachedRepositoryStats(t *testing.T) {
+	repo := badman.NewCachedRepository(badman.NewInMemoryRepository(), badman.CacheConfig{})
+	require.NoError(t, repo.Put([]*badman.BadEntity{
+		{Name: "blue.example.com", SavedAt: time.Now(), Src: "tester"},
+	}))
+
+	for i := 0; i < 3; i++ {
+		entities, err := repo.Get("blue.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, 1, len(entities))
+
+		// Negative result is also cached.
+		entities, err = repo.Get("orange.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(entities))
+	}
+
+	stats := repo.Stats()
+	assert.Equal(t, uint64(4), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 2, stats.Entries)
+	assert.InDelta(t, 4.0/6.0, stats.HitRate(), 0.001)
+}
+
+func TestCachedRepositoryInvalidation(t *testing.T) {
+	base := badman.NewInMemoryRepository()
+	repo := badman.NewCachedRepository(base, badman.CacheConfig{})
+
+	entities, err := repo.Get("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entities))
+	networks, err := repo.GetNetworks(net.ParseIP("192.0.2.1"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(networks))
+
+	// Put via cached repository invalidates negative results.
+	require.NoError(t, repo.Put([]*badman.BadEntity{
+		{Name: "blue.example.com", SavedAt: time.Now(), Src: "tester"},
+		{Name: "192.0.2.0/24", SavedAt: time.Now(), Src: "tester"},
+	}))
+	entities, err = repo.Get("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+	networks, err = repo.GetNetworks(net.ParseIP("192.0.2.1"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(networks))
+
+	// Del via cached repository invalidates positive results.
+	require.NoError(t, repo.Del("192.0.2.0/24"))
+	networks, err = repo.GetNetworks(net.ParseIP("192.0.2.1"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(networks))
+
+	// Change of backend is not visible until TTL expires.
+	require.NoError(t, base.Del("blue.example.com"))
+	entities, err = repo.Get("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+
+	repo.Purge()
+	entities, err = repo.Get("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entities))
+}
+
+func TestCachedRepositoryTTL(t *testing.T) {
+	base := badman.NewInMemoryRepository()
+	repo := badman.NewCachedRepository(base, badman.CacheConfig{TTL: time.Hour, NegativeTTL: 50 * time.Millisecond})
+
+	entities, err := repo.Get("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entities))
+
+	require.NoError(t, base.Put([]*badman.BadEntity{
+		{Name: "blue.example.com", SavedAt: time.Now(), Src: "tester"},
+	}))
+	time.Sleep(100 * time.Millisecond)
+
+	entities, err = repo.Get("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+}
+
+func TestCachedRepositoryEntityExpiration(t *testing.T) {
+	repo := badman.NewCachedRepository(badman.NewInMemoryRepository(), badman.CacheConfig{TTL: time.Hour})
+	require.NoError(t, repo.Put([]*badman.BadEntity{
+		{Name: "blue.example.com", SavedAt: time.Now(), Src: "tester1", ExpiresAt: time.Now().Add(50 * time.Millisecond)},
+		{Name: "blue.example.com", SavedAt: time.Now(), Src: "tester2"},
+	}))
+
+	entities, err := repo.Get("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(entities))
+
+	// Cached result is not returned after an entity in it expired even if TTL remains.
+	time.Sleep(100 * time.Millisecond)
+	entities, err = repo.Get("blue.example.com")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entities))
+	assert.Equal(t, "tester2", entities[0].Src)
+}
+
+func TestCachedRepositoryEviction(t *testing.T) {
+	repo := badman.NewCachedRepository(badman.NewInMemoryRepository(), badman.CacheConfig{Size: 10})
+	for i := 0; i < 25; i++ {
+		_, err := repo.Get(fmt.Sprintf("%d.example.com", i))
+		require.NoError(t, err)
+	}
+
+	stats := repo.Stats()
+	assert.Equal(t, 10, stats.Entries)
+	assert.Equal(t, uint64(15), stats.Evictions)
+
+	// The most recently used one is still cached.
+	_, err := repo.Get("24.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), repo.Stats().Hits)
+}
+
+func TestCachedRepositoryClose(t *testing.T) {
+	base, cleanup := newBoltRepository(t)
+	defer cleanup()
+
+	// Closing is left to cleanup, only check that Close of backend is exposed.
+	repo := badman.NewCachedRepository(base, badman.CacheConfig{})
+	_, ok := repo.(io.Closer)
+	assert.True(t, ok)
+
+	_, ok = badman.NewCachedRepository(badman.NewInMemoryRepository(), badman.CacheConfig{}).(io.Closer)
+	assert.False(t, ok)
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/m-mizutani/badman"
 	"github.com/m-mizutani/badman/source"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	cli "github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ed25519"
 )
 
 var logger = logrus.New()
@@ -21,6 +27,14 @@ func main() {
 
 func handler(args []string) error {
 	var output string
+	var bestEffort bool
+	var from, to, checkpoint string
+	var batchSize, capacity int
+	var fpRate float64
+	var signKey, signature string
+	var force bool
+	var format, columns string
+	var noFormulaEscape bool
 
 	app := &cli.App{
 		Name:  "badman",
@@ -31,21 +45,46 @@ func handler(args []string) error {
 				Aliases: []string{"d"},
 				Usage:   "Download sources and output serialized data",
 				Action: func(c *cli.Context) error {
-					man := badman.New()
-					if err := man.Download(source.DefaultSet); err != nil {
-						return errors.Wrapf(err, "Fail to download blacklists")
+					if signature != "" && signKey == "" {
+						return errors.New("--sign-key is required to output detached signature")
 					}
 
-					var out io.Writer
-					if output == "-" {
-						out = os.Stdout
-					} else {
-						fd, err := os.Create(output)
+					ser, err := newSerializer(format, columns, noFormulaEscape)
+					if err != nil {
+						return err
+					}
+
+					man, err := download(badman.NewInMemoryRepository(), bestEffort)
+					if err != nil {
+						return err
+					}
+					man.ReplaceSerializer(ser)
+
+					if signKey != "" {
+						key, err := readSigningKey(signKey)
 						if err != nil {
-							return errors.Wrapf(err, "Fail to create output file: %s", output)
+							return err
 						}
-						defer fd.Close()
-						out = fd
+						man.SetSigningKey(key)
+					}
+
+					out, closeOutput, err := openOutput(output)
+					if err != nil {
+						return err
+					}
+					defer closeOutput()
+
+					if signature != "" {
+						sigOut, closeSig, err := openOutput(signature)
+						if err != nil {
+							return err
+						}
+						defer closeSig()
+
+						if err := man.DumpDetached(out, sigOut); err != nil {
+							return errors.Wrapf(err, "Fail to output blacklists")
+						}
+						return nil
 					}
 
 					if err := man.Dump(out); err != nil {
@@ -62,6 +101,383 @@ func handler(args []string) error {
 						Value:       "-",
 						Destination: &output,
 					},
+					&cli.BoolFlag{
+						Name:        "best-effort",
+						Usage:       "Dump blacklists of available sources even if some sources fail",
+						Destination: &bestEffort,
+					},
+					&cli.StringFlag{
+						Name:        "sign-key",
+						Usage:       "ed25519 private key file (PEM) to sign output",
+						Aliases:     []string{"k"},
+						Destination: &signKey,
+					},
+					&cli.StringFlag{
+						Name:        "signature",
+						Usage:       "Output file name of detached signature. Signature is embedded in output if not set",
+						Aliases:     []string{"s"},
+						Destination: &signature,
+					},
+					&cli.StringFlag{
+						Name:        "format",
+						Usage:       "Output format: gzip-msgpack, msgpack, gzip-json, json, csv or tsv",
+						Value:       "gzip-msgpack",
+						Destination: &format,
+					},
+					&cli.StringFlag{
+						Name:        "columns",
+						Usage:       "Comma separated columns of csv and tsv format, e.g. name,kind,source,reason,saved_at,expires_at",
+						Destination: &columns,
+					},
+					&cli.BoolFlag{
+						Name:        "no-formula-escape",
+						Usage:       "Do not escape values of csv and tsv format that start with =, +, -, @, tab or carriage return",
+						Destination: &noFormulaEscape,
+					},
+				},
+			},
+			{
+				Name:  "keygen",
+				Usage: "Generate ed25519 key pair to sign and verify serialized data",
+				Action: func(c *cli.Context) error {
+					pub, priv, err := ed25519.GenerateKey(rand.Reader)
+					if err != nil {
+						return errors.Wrap(err, "Fail to generate key")
+					}
+
+					privPEM, err := badman.MarshalSigningKey(priv)
+					if err != nil {
+						return err
+					}
+					pubPEM, err := badman.MarshalTrustedKey(pub)
+					if err != nil {
+						return err
+					}
+
+					// Both files are created before writing not to leave a half of key pair when one of them exists.
+					privFd, err := createKeyFile(output+".key", 0600, force)
+					if err != nil {
+						return err
+					}
+					pubFd, err := createKeyFile(output+".pub", 0644, force)
+					if err != nil {
+						privFd.Close()
+						os.Remove(output + ".key")
+						return err
+					}
+
+					if err := writeKeyFile(privFd, privPEM); err != nil {
+						pubFd.Close()
+						return errors.Wrapf(err, "Fail to write private key: %s.key", output)
+					}
+					if err := writeKeyFile(pubFd, pubPEM); err != nil {
+						return errors.Wrapf(err, "Fail to write public key: %s.pub", output)
+					}
+
+					logger.WithFields(logrus.Fields{
+						"private": output + ".key",
+						"public":  output + ".pub",
+						"key_id":  badman.SigningKeyID(pub),
+					}).Info("Generated key pair")
+					return nil
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "output",
+						Usage:       "Prefix of output files, PREFIX.key (private key) and PREFIX.pub (public key)",
+						Aliases:     []string{"o"},
+						Value:       "badman",
+						Destination: &output,
+					},
+					&cli.BoolFlag{
+						Name:        "force",
+						Usage:       "Overwrite existing key files",
+						Aliases:     []string{"f"},
+						Destination: &force,
+					},
+				},
+			},
+			{
+				Name:      "verify",
+				Usage:     "Verify signature of serialized data",
+				ArgsUsage: "FILE",
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("A serialized data file is required")
+					}
+
+					var keys []ed25519.PublicKey
+					for _, path := range c.StringSlice("key") {
+						key, err := readTrustedKey(path)
+						if err != nil {
+							return err
+						}
+						keys = append(keys, key)
+					}
+
+					var sig *badman.DumpSignature
+					if signature != "" {
+						fd, err := os.Open(signature)
+						if err != nil {
+							return errors.Wrapf(err, "Fail to open signature file: %s", signature)
+						}
+						defer fd.Close()
+						if sig, err = badman.ReadDumpSignature(fd); err != nil {
+							return err
+						}
+					}
+
+					fd, err := os.Open(c.Args().First())
+					if err != nil {
+						return errors.Wrapf(err, "Fail to open serialized data: %s", c.Args().First())
+					}
+					defer fd.Close()
+
+					header, err := badman.VerifyDump(fd, sig, keys...)
+					if err != nil {
+						return err
+					}
+
+					logger.WithFields(logrus.Fields{
+						"encoding":    header.Encoding,
+						"compression": header.Compression,
+						"created_at":  header.CreatedAt,
+						"entities":    header.Entities,
+					}).Info("Verified serialized data")
+					return nil
+				},
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "key",
+						Usage:    "Trusted ed25519 public key file (PEM), can be specified multiple times",
+						Aliases:  []string{"k"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:        "signature",
+						Usage:       "Detached signature file. Embedded signature is verified if not set",
+						Aliases:     []string{"s"},
+						Destination: &signature,
+					},
+				},
+			},
+			{
+				Name:    "bloom",
+				Aliases: []string{"b"},
+				Usage:   "Build bloom filter of blacklisted names",
+				Action: func(c *cli.Context) error {
+					var repo badman.Repository
+					if from != "" {
+						r, err := openRepository(from)
+						if err != nil {
+							return errors.Wrapf(err, "Fail to open source repository")
+						}
+						defer closeRepository(r)
+						repo = r
+					} else {
+						repo = badman.NewInMemoryRepository()
+						if _, err := download(repo, bestEffort); err != nil {
+							return err
+						}
+					}
+
+					filter, err := badman.BuildBloomFilter(context.Background(), repo, badman.BloomConfig{
+						Capacity:          capacity,
+						FalsePositiveRate: fpRate,
+					})
+					if err != nil {
+						return err
+					}
+
+					out, closeOutput, err := openOutput(output)
+					if err != nil {
+						return err
+					}
+					defer closeOutput()
+
+					if _, err := filter.WriteTo(out); err != nil {
+						return errors.Wrapf(err, "Fail to output bloom filter")
+					}
+
+					logger.WithField("names", filter.Count()).Info("Built bloom filter")
+					return nil
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "output",
+						Usage:       "Output file name, '-' means stdout",
+						Aliases:     []string{"o"},
+						Value:       "-",
+						Destination: &output,
+					},
+					&cli.StringFlag{
+						Name:        "from",
+						Usage:       "Source repository URI. Blacklists are downloaded if not set",
+						Aliases:     []string{"f"},
+						Destination: &from,
+					},
+					&cli.BoolFlag{
+						Name:        "best-effort",
+						Usage:       "Use blacklists of available sources even if some sources fail",
+						Destination: &bestEffort,
+					},
+					&cli.IntFlag{
+						Name:        "capacity",
+						Usage:       "Expected number of names",
+						Value:       1000000,
+						Destination: &capacity,
+					},
+					&cli.Float64Flag{
+						Name:        "fp-rate",
+						Usage:       "False positive rate",
+						Value:       0.01,
+						Destination: &fpRate,
+					},
+				},
+			},
+			{
+				Name:  "delta",
+				Usage: "Output delta between two repositories or serialized data files",
+				Action: func(c *cli.Context) error {
+					base, err := openRepository(from)
+					if err != nil {
+						return errors.Wrapf(err, "Fail to open base repository")
+					}
+					defer closeRepository(base)
+
+					target, err := openRepository(to)
+					if err != nil {
+						return errors.Wrapf(err, "Fail to open target repository")
+					}
+					defer closeRepository(target)
+
+					man := badman.New()
+					man.ReplaceRepository(target)
+					if signKey != "" {
+						key, err := readSigningKey(signKey)
+						if err != nil {
+							return err
+						}
+						man.SetSigningKey(key)
+					}
+
+					out, closeOutput, err := openOutput(output)
+					if err != nil {
+						return err
+					}
+					defer closeOutput()
+
+					if err := man.DumpDelta(out, base); err != nil {
+						return errors.Wrapf(err, "Fail to output delta")
+					}
+					return nil
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "base",
+						Usage:       "Base repository URI, e.g. file:old.dat",
+						Aliases:     []string{"b"},
+						Required:    true,
+						Destination: &from,
+					},
+					&cli.StringFlag{
+						Name:        "target",
+						Usage:       "Target repository URI, e.g. file:new.dat",
+						Aliases:     []string{"t"},
+						Required:    true,
+						Destination: &to,
+					},
+					&cli.StringFlag{
+						Name:        "output",
+						Usage:       "Output file name, '-' means stdout",
+						Aliases:     []string{"o"},
+						Value:       "-",
+						Destination: &output,
+					},
+					&cli.StringFlag{
+						Name:        "sign-key",
+						Usage:       "ed25519 private key file (PEM) to sign output",
+						Aliases:     []string{"k"},
+						Destination: &signKey,
+					},
+				},
+			},
+			{
+				Name:    "migrate",
+				Aliases: []string{"m"},
+				Usage:   "Copy entities from a repository to another repository",
+				Action: func(c *cli.Context) error {
+					src, err := openRepository(from)
+					if err != nil {
+						return errors.Wrapf(err, "Fail to open source repository")
+					}
+					defer closeRepository(src)
+
+					dst, err := openRepository(to)
+					if err != nil {
+						return errors.Wrapf(err, "Fail to open destination repository")
+					}
+					defer closeRepository(dst)
+
+					opts := badman.CopyOptions{
+						BatchSize: batchSize,
+						Progress: func(r badman.CopyReport) {
+							logger.WithFields(logrus.Fields{
+								"entities": r.Entities,
+								"skipped":  r.Skipped,
+								"duration": r.Duration,
+							}).Info("Copying entities")
+						},
+					}
+					if checkpoint != "" {
+						cp, err := badman.NewFileCheckpoint(checkpoint)
+						if err != nil {
+							return err
+						}
+						defer cp.(io.Closer).Close()
+						opts.Checkpoint = cp
+					}
+
+					report, err := badman.CopyRepository(context.Background(), dst, src, opts)
+					if err != nil {
+						return errors.Wrapf(err, "Fail to migrate repository")
+					}
+
+					logger.WithFields(logrus.Fields{
+						"entities": report.Entities,
+						"skipped":  report.Skipped,
+						"duration": report.Duration,
+					}).Info("Migrated repository")
+					return nil
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "from",
+						Usage:       "Source repository URI, e.g. bolt:badman.db, file:badman.dat",
+						Aliases:     []string{"f"},
+						Required:    true,
+						Destination: &from,
+					},
+					&cli.StringFlag{
+						Name:        "to",
+						Usage:       "Destination repository URI, e.g. dynamodb://ap-northeast-1/badman",
+						Aliases:     []string{"t"},
+						Required:    true,
+						Destination: &to,
+					},
+					&cli.IntFlag{
+						Name:        "batch-size",
+						Usage:       "Number of entities that are put into destination at once",
+						Aliases:     []string{"b"},
+						Value:       1000,
+						Destination: &batchSize,
+					},
+					&cli.StringFlag{
+						Name:        "checkpoint",
+						Usage:       "File to record copied entities to resume interrupted migration",
+						Aliases:     []string{"c"},
+						Destination: &checkpoint,
+					},
 				},
 			},
 		},
@@ -69,3 +485,147 @@ func handler(args []string) error {
 
 	return app.Run(args)
 }
+
+// closeRepository closes repo if it has resources to release.
+func closeRepository(repo badman.Repository) {
+	if closer, ok := repo.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.WithError(err).Warn("Fail to close repository")
+		}
+	}
+}
+
+// download returns BadMan that has downloaded blacklists of source.DefaultSet into repo.
+func download(repo badman.Repository, bestEffort bool) (*badman.BadMan, error) {
+	man := badman.New()
+	man.ReplaceRepository(repo)
+	man.SetInvalidEntityHandler(func(entity badman.BadEntity, err error) {
+		logger.WithError(err).WithField("src", entity.Src).Warn("Discard invalid entity")
+	})
+
+	if bestEffort {
+		man.SetDownloadPolicy(badman.BestEffort)
+	}
+	report, err := man.DownloadWithReport(source.DefaultSet)
+	for _, r := range report.Sources {
+		log := logger.WithFields(logrus.Fields{
+			"source":   fmt.Sprintf("%T", r.Source),
+			"entities": r.Entities,
+			"invalid":  r.Invalid,
+			"duration": r.Duration,
+		})
+		switch {
+		case r.Error != nil:
+			log.WithError(r.Error).Warn("Fail to download blacklist")
+		case !r.Completed:
+			log.Warn("Download of blacklist did not complete")
+		default:
+			log.Info("Downloaded blacklist")
+		}
+	}
+
+	// Only failures of some sources are ignored in best-effort mode. Failure of repository or of all sources is still an error.
+	if err != nil {
+		srcErr, ok := errors.Cause(err).(*badman.SourceError)
+		if !bestEffort || !ok || srcErr.Failed == srcErr.Total {
+			return nil, errors.Wrapf(err, "Fail to download blacklists")
+		}
+	}
+
+	return man, nil
+}
+
+// createKeyFile creates a key file with mode. Existing file is an error unless force is true, and then it's truncated and its mode is changed to mode.
+func createKeyFile(path string, mode os.FileMode, force bool) (*os.File, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	fd, err := os.OpenFile(path, flag, mode)
+	if os.IsExist(err) {
+		return nil, errors.Errorf("Key file already exists, use --force to overwrite: %s", path)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create key file: %s", path)
+	}
+
+	if force {
+		if err := fd.Chmod(mode); err != nil {
+			fd.Close()
+			return nil, errors.Wrapf(err, "Fail to change mode of key file: %s", path)
+		}
+	}
+	return fd, nil
+}
+
+// writeKeyFile writes data into fd and closes it.
+func writeKeyFile(fd *os.File, data []byte) error {
+	if _, err := fd.Write(data); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// newSerializer returns Serializer of format. columns and noFormulaEscape are used only for csv and tsv format.
+func newSerializer(format, columns string, noFormulaEscape bool) (badman.Serializer, error) {
+	var cols []string
+	if columns != "" {
+		cols = strings.Split(columns, ",")
+	}
+
+	switch format {
+	case "gzip-msgpack":
+		return badman.NewGzipMsgpackSerializer(), nil
+	case "msgpack":
+		return badman.NewMsgpackSerializer(), nil
+	case "gzip-json":
+		return badman.NewGzipJSONSerializer(), nil
+	case "json":
+		return badman.NewJSONSerializer(), nil
+	case "csv", "tsv":
+		newCSV := badman.NewCSVSerializer
+		if format == "tsv" {
+			newCSV = badman.NewTSVSerializer
+		}
+		ser, err := newCSV(cols...)
+		if err != nil {
+			return nil, err
+		}
+		ser.SetFormulaEscape(!noFormulaEscape)
+		return ser, nil
+	default:
+		return nil, errors.Errorf("Unsupported format: %s", format)
+	}
+}
+
+// readSigningKey reads ed25519 private key from PEM file.
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read signing key: %s", path)
+	}
+	return badman.ParseSigningKey(data)
+}
+
+// readTrustedKey reads ed25519 public key from PEM file.
+func readTrustedKey(path string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read trusted key: %s", path)
+	}
+	return badman.ParseTrustedKey(data)
+}
+
+// openOutput returns writer of output file. "-" means stdout.
+func openOutput(output string) (io.Writer, func(), error) {
+	if output == "-" {
+		return os.Stdout, func() {}, nil
+	}
+
+	fd, err := os.Create(output)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Fail to create output file: %s", output)
+	}
+	return fd, func() { fd.Close() }, nil
+}
@@ -1,9 +1,13 @@
 package main_test
 
 import (
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -31,3 +35,183 @@ func TestDownloadAndDump(t *testing.T) {
 
 	os.Remove(tmp.Name())
 }
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badman")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	man := badman.New()
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "blue.example.com", SavedAt: time.Now(), Src: "tester"}))
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "192.0.2.0/24", SavedAt: time.Now(), Src: "tester"}))
+	dump := filepath.Join(dir, "badman.dat")
+	fd, err := os.Create(dump)
+	require.NoError(t, err)
+	require.NoError(t, man.Dump(fd))
+	require.NoError(t, fd.Close())
+
+	db := filepath.Join(dir, "badman.db")
+	err = main.Handler([]string{"./badman", "migrate", "-f", "file:" + dump, "-t", "bolt:" + db,
+		"-c", filepath.Join(dir, "checkpoint")})
+	require.NoError(t, err)
+
+	repo, err := badman.NewBoltRepository(db)
+	require.NoError(t, err)
+	defer repo.(io.Closer).Close()
+
+	entities, err := repo.Get("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+	networks, err := repo.GetNetworks(net.ParseIP("192.0.2.1"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(networks))
+}
+
+func TestMigrateUnsupportedRepository(t *testing.T) {
+	err := main.Handler([]string{"./badman", "migrate", "-f", "unknown://x", "-t", "unknown://y"})
+	assert.Error(t, err)
+}
+
+func TestBloom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badman")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db := filepath.Join(dir, "badman.db")
+	repo, err := badman.NewBoltRepository(db)
+	require.NoError(t, err)
+	require.NoError(t, repo.Put([]*badman.BadEntity{
+		{Name: "blue.example.com", SavedAt: time.Now(), Src: "tester"},
+	}))
+	require.NoError(t, repo.(io.Closer).Close())
+
+	output := filepath.Join(dir, "badman.bloom")
+	err = main.Handler([]string{"./badman", "bloom", "-f", "bolt:" + db, "-o", output, "--capacity", "100"})
+	require.NoError(t, err)
+
+	fd, err := os.Open(output)
+	require.NoError(t, err)
+	defer fd.Close()
+	filter, err := badman.ReadBloomFilter(fd)
+	require.NoError(t, err)
+	assert.True(t, filter.Test("blue.example.com"))
+}
+
+func TestKeygenAndVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badman")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prefix := filepath.Join(dir, "test")
+	require.NoError(t, main.Handler([]string{"./badman", "keygen", "-o", prefix}))
+
+	privPEM, err := ioutil.ReadFile(prefix + ".key")
+	require.NoError(t, err)
+	key, err := badman.ParseSigningKey(privPEM)
+	require.NoError(t, err)
+
+	man := badman.New()
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "blue.example.com", SavedAt: time.Now(), Src: "tester"}))
+	man.SetSigningKey(key)
+
+	embedded := filepath.Join(dir, "embedded.dat")
+	fd, err := os.Create(embedded)
+	require.NoError(t, err)
+	require.NoError(t, man.Dump(fd))
+	require.NoError(t, fd.Close())
+
+	detached := filepath.Join(dir, "detached.dat")
+	fd, err = os.Create(detached)
+	require.NoError(t, err)
+	sig, err := os.Create(detached + ".sig")
+	require.NoError(t, err)
+	require.NoError(t, man.DumpDetached(fd, sig))
+	require.NoError(t, fd.Close())
+	require.NoError(t, sig.Close())
+
+	assert.NoError(t, main.Handler([]string{"./badman", "verify", "-k", prefix + ".pub", embedded}))
+	assert.NoError(t, main.Handler([]string{"./badman", "verify", "-k", prefix + ".pub", "-s", detached + ".sig", detached}))
+	assert.Error(t, main.Handler([]string{"./badman", "verify", "-k", prefix + ".pub", detached}))
+
+	other := filepath.Join(dir, "other")
+	require.NoError(t, main.Handler([]string{"./badman", "keygen", "-o", other}))
+	assert.Error(t, main.Handler([]string{"./badman", "verify", "-k", other + ".pub", embedded}))
+}
+
+func TestKeygenOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badman")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prefix := filepath.Join(dir, "test")
+	require.NoError(t, main.Handler([]string{"./badman", "keygen", "-o", prefix}))
+	privPEM, err := ioutil.ReadFile(prefix + ".key")
+	require.NoError(t, err)
+
+	// Existing key is not overwritten without --force.
+	assert.Error(t, main.Handler([]string{"./badman", "keygen", "-o", prefix}))
+	privPEM2, err := ioutil.ReadFile(prefix + ".key")
+	require.NoError(t, err)
+	assert.Equal(t, privPEM, privPEM2)
+
+	// Public key only exists: private key must not be left.
+	require.NoError(t, os.Remove(prefix+".key"))
+	assert.Error(t, main.Handler([]string{"./badman", "keygen", "-o", prefix}))
+	_, err = os.Stat(prefix + ".key")
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, ioutil.WriteFile(prefix+".key", []byte("old"), 0644))
+	require.NoError(t, main.Handler([]string{"./badman", "keygen", "-o", prefix, "--force"}))
+	info, err := os.Stat(prefix + ".key")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	privPEM3, err := ioutil.ReadFile(prefix + ".key")
+	require.NoError(t, err)
+	_, err = badman.ParseSigningKey(privPEM3)
+	assert.NoError(t, err)
+}
+
+func TestDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badman")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dump := func(path string, names ...string) {
+		man := badman.New()
+		for _, name := range names {
+			require.NoError(t, man.Insert(badman.BadEntity{Name: name, SavedAt: time.Now(), Src: "tester"}))
+		}
+		fd, err := os.Create(path)
+		require.NoError(t, err)
+		require.NoError(t, man.Dump(fd))
+		require.NoError(t, fd.Close())
+	}
+
+	base, target := filepath.Join(dir, "base.dat"), filepath.Join(dir, "target.dat")
+	dump(base, "blue.example.com", "orange.example.com")
+	dump(target, "blue.example.com", "red.example.com")
+
+	delta := filepath.Join(dir, "delta.dat")
+	err = main.Handler([]string{"./badman", "delta", "-b", "file:" + base, "-t", "file:" + target, "-o", delta})
+	require.NoError(t, err)
+
+	man := badman.New()
+	for _, path := range []string{base, delta} {
+		fd, err := os.Open(path)
+		require.NoError(t, err)
+		require.NoError(t, man.Load(fd))
+		fd.Close()
+	}
+
+	entities, err := man.Lookup("red.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+	entities, err = man.Lookup("orange.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entities))
+}
+
+func TestDumpUnsupportedFormat(t *testing.T) {
+	assert.Error(t, main.Handler([]string{"./badman", "dump", "--format", "xml"}))
+	assert.Error(t, main.Handler([]string{"./badman", "dump", "--format", "csv", "--columns", "name,unknown"}))
+}
@@ -0,0 +1,274 @@
+package badman
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Columns of CSVSerializer.
+const (
+	CSVColumnName      = "name"
+	CSVColumnKind      = "kind"
+	CSVColumnSource    = "source"
+	CSVColumnReason    = "reason"
+	CSVColumnSavedAt   = "saved_at"
+	CSVColumnExpiresAt = "expires_at"
+	CSVColumnFirstSeen = "first_seen"
+	CSVColumnLastSeen  = "last_seen"
+	CSVColumnSightings = "sightings"
+)
+
+// DefaultCSVColumns is columns of CSVSerializer if no column is specified.
+var DefaultCSVColumns = []string{
+	CSVColumnName,
+	CSVColumnKind,
+	CSVColumnSource,
+	CSVColumnReason,
+	CSVColumnSavedAt,
+}
+
+// csvField converts a field of BadEntity from/to a value of CSV.
+type csvField struct {
+	format func(entity *BadEntity) string
+	parse  func(entity *BadEntity, value string) error
+}
+
+var csvFields = map[string]csvField{
+	CSVColumnName: {
+		format: func(e *BadEntity) string { return e.Name },
+		parse:  func(e *BadEntity, v string) error { e.Name = v; return nil },
+	},
+	CSVColumnKind: {
+		format: func(e *BadEntity) string { return string(e.Kind) },
+		parse:  func(e *BadEntity, v string) error { e.Kind = EntityKind(v); return nil },
+	},
+	CSVColumnSource: {
+		format: func(e *BadEntity) string { return e.Src },
+		parse:  func(e *BadEntity, v string) error { e.Src = v; return nil },
+	},
+	CSVColumnReason: {
+		format: func(e *BadEntity) string { return e.Reason },
+		parse:  func(e *BadEntity, v string) error { e.Reason = v; return nil },
+	},
+	CSVColumnSavedAt:   csvTimeField(func(e *BadEntity) *time.Time { return &e.SavedAt }),
+	CSVColumnExpiresAt: csvTimeField(func(e *BadEntity) *time.Time { return &e.ExpiresAt }),
+	CSVColumnFirstSeen: csvTimeField(func(e *BadEntity) *time.Time { return &e.FirstSeen }),
+	CSVColumnLastSeen:  csvTimeField(func(e *BadEntity) *time.Time { return &e.LastSeen }),
+	CSVColumnSightings: {
+		format: func(e *BadEntity) string {
+			if e.Sightings == 0 {
+				return ""
+			}
+			return strconv.Itoa(e.Sightings)
+		},
+		parse: func(e *BadEntity, v string) error {
+			if v == "" {
+				return nil
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			e.Sightings = n
+			return nil
+		},
+	},
+}
+
+// csvTimeField returns csvField of time in RFC 3339 format. Zero time is empty.
+func csvTimeField(field func(e *BadEntity) *time.Time) csvField {
+	return csvField{
+		format: func(e *BadEntity) string {
+			if t := field(e); !t.IsZero() {
+				return t.Format(time.RFC3339Nano)
+			}
+			return ""
+		},
+		parse: func(e *BadEntity, v string) error {
+			if v == "" {
+				return nil
+			}
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return err
+			}
+			*field(e) = t
+			return nil
+		},
+	}
+}
+
+// csvFormulaPrefix is prepended to a value that can be interpreted as formula by spreadsheets.
+const csvFormulaPrefix = '\''
+
+// csvIsFormula returns true if a spreadsheet may interpret v as formula: it starts with =, +, -, @, tab or carriage return.
+func csvIsFormula(v string) bool {
+	return v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0]))
+}
+
+// csvNeedsEscape returns true if v is formula or looks like an escaped value, then escaping of v can be reverted without ambiguity.
+func csvNeedsEscape(v string) bool {
+	return csvIsFormula(v) || (v != "" && v[0] == csvFormulaPrefix && csvIsFormula(v[1:]))
+}
+
+func csvEscapeFormula(v string) string {
+	if csvNeedsEscape(v) {
+		return string(csvFormulaPrefix) + v
+	}
+	return v
+}
+
+func csvUnescapeFormula(v string) string {
+	if v != "" && v[0] == csvFormulaPrefix && csvNeedsEscape(v[1:]) {
+		return v[1:]
+	}
+	return v
+}
+
+// CSVSerializer is CSV (RFC 4180) or TSV serializer with selectable columns. A header row of column names is written at first. It does not implement FormatSerializer to output plain CSV that can be opened by spreadsheets, then Load of the output requires CSVSerializer as current Serializer. Values that start with =, +, -, @, tab or carriage return are escaped by a single quote by default not to be interpreted as formula (CSV injection), see SetFormulaEscape.
+type CSVSerializer struct {
+	columns []string
+	comma   rune
+	crlf    bool
+	escape  bool
+}
+
+// NewCSVSerializer is constructor of CSVSerializer that outputs CSV with CRLF line break. DefaultCSVColumns is used if columns is empty. Error is returned if a column is unknown.
+func NewCSVSerializer(columns ...string) (*CSVSerializer, error) {
+	return newCSVSerializer(columns, ',', true)
+}
+
+// NewTSVSerializer is constructor of CSVSerializer that outputs TSV (tab separated values) with LF line break. DefaultCSVColumns is used if columns is empty. Error is returned if a column is unknown.
+func NewTSVSerializer(columns ...string) (*CSVSerializer, error) {
+	return newCSVSerializer(columns, '\t', false)
+}
+
+func newCSVSerializer(columns []string, comma rune, crlf bool) (*CSVSerializer, error) {
+	if len(columns) == 0 {
+		columns = DefaultCSVColumns
+	}
+
+	used := make(map[string]bool)
+	for _, column := range columns {
+		if _, ok := csvFields[column]; !ok {
+			return nil, errors.Errorf("Unknown CSV column: %s", column)
+		}
+		if used[column] {
+			return nil, errors.Errorf("Duplicated CSV column: %s", column)
+		}
+		used[column] = true
+	}
+
+	return &CSVSerializer{
+		columns: append([]string{}, columns...),
+		comma:   comma,
+		crlf:    crlf,
+		escape:  true,
+	}, nil
+}
+
+// SetFormulaEscape enables or disables escaping of values that can be interpreted as formula by spreadsheets. A single quote is prepended to a value that starts with =, +, -, @, tab or carriage return (and to a value that starts with a single quote followed by one of them), and Deserialize removes it. Escaping is enabled by default, and should be disabled only if the output is never opened by spreadsheets and consumers require raw values. Serialize and Deserialize must use same setting.
+func (x *CSVSerializer) SetFormulaEscape(enabled bool) {
+	x.escape = enabled
+}
+
+// Serialize of CSVSerializer writes a header row and a row for each entity. Fields are quoted if needed as RFC 4180.
+func (x *CSVSerializer) Serialize(ch chan *EntityQueue, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Comma = x.comma
+	writer.UseCRLF = x.crlf
+
+	if err := writer.Write(x.columns); err != nil {
+		return errors.Wrap(err, "Fail to write CSV header")
+	}
+
+	row := make([]string, len(x.columns))
+	for q := range ch {
+		if q.Error != nil {
+			return q.Error
+		}
+
+		for _, e := range q.Entities {
+			for i, column := range x.columns {
+				row[i] = csvFields[column].format(e)
+				if x.escape {
+					row[i] = csvEscapeFormula(row[i])
+				}
+			}
+			if err := writer.Write(row); err != nil {
+				return errors.Wrapf(err, "Fail to write entity as CSV: %v", e)
+			}
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return errors.Wrap(err, "Fail to write CSV")
+	}
+	return nil
+}
+
+// Deserialize of CSVSerializer reads CSV that has a header row. Columns are decided by the header row instead of columns of CSVSerializer, and unknown columns are ignored. The header row must have "name" column.
+func (x *CSVSerializer) Deserialize(r io.Reader) chan *EntityQueue {
+	ch := make(chan *EntityQueue, jsonSerializerBufSize)
+
+	go func() {
+		defer close(ch)
+		reader := csv.NewReader(r)
+		reader.Comma = x.comma
+
+		header, err := reader.Read()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			ch <- &EntityQueue{Error: errors.Wrap(err, "Fail to read CSV header")}
+			return
+		}
+
+		fields := make([]*csvField, len(header))
+		hasName := false
+		for i, column := range header {
+			if field, ok := csvFields[column]; ok {
+				fields[i] = &field
+				hasName = hasName || column == CSVColumnName
+			}
+		}
+		if !hasName {
+			ch <- &EntityQueue{Error: errors.Errorf("CSV header must have %q column: %v", CSVColumnName, header)}
+			return
+		}
+
+		for record := 1; ; record++ {
+			row, err := reader.Read()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				ch <- &EntityQueue{Error: errors.Wrap(err, "Fail to read CSV")}
+				return
+			}
+
+			var entity BadEntity
+			for i, value := range row {
+				if fields[i] == nil {
+					continue
+				}
+				if x.escape {
+					value = csvUnescapeFormula(value)
+				}
+				if err := fields[i].parse(&entity, value); err != nil {
+					ch <- &EntityQueue{Error: errors.Wrapf(err, "Fail to parse %s column of CSV at record %d", header[i], record)}
+					return
+				}
+			}
+
+			ch <- &EntityQueue{Entities: []*BadEntity{&entity}}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,202 @@
+package badman_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/badman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSVSerializer(t *testing.T) {
+	ser, err := badman.NewCSVSerializer()
+	require.NoError(t, err)
+	serializerCommonTest(t, ser)
+}
+
+func TestTSVSerializer(t *testing.T) {
+	ser, err := badman.NewTSVSerializer()
+	require.NoError(t, err)
+	serializerCommonTest(t, ser)
+}
+
+func serializeCSV(t *testing.T, ser badman.Serializer, entities ...*badman.BadEntity) string {
+	ch := make(chan *badman.EntityQueue, 1)
+	ch <- &badman.EntityQueue{Entities: entities}
+	close(ch)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, ser.Serialize(ch, buf))
+	return buf.String()
+}
+
+func deserializeCSV(ser badman.Serializer, data string) ([]*badman.BadEntity, error) {
+	var entities []*badman.BadEntity
+	for q := range ser.Deserialize(strings.NewReader(data)) {
+		if q.Error != nil {
+			return nil, q.Error
+		}
+		entities = append(entities, q.Entities...)
+	}
+	return entities, nil
+}
+
+func TestCSVSerializerColumns(t *testing.T) {
+	ser, err := badman.NewCSVSerializer(badman.CSVColumnName, badman.CSVColumnReason, badman.CSVColumnSightings)
+	require.NoError(t, err)
+
+	out := serializeCSV(t, ser,
+		&badman.BadEntity{Name: "blue.example.com", Reason: `phishing, "urgent"`, Sightings: 3, Src: "tester"},
+		&badman.BadEntity{Name: "10.1.2.3", Reason: "multi\nline"},
+	)
+	assert.Equal(t, "name,reason,sightings\r\n"+
+		"blue.example.com,\"phishing, \"\"urgent\"\"\",3\r\n"+
+		"10.1.2.3,\"multi\r\nline\",\r\n", out)
+
+	entities, err := deserializeCSV(ser, out)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(entities))
+	assert.Equal(t, `phishing, "urgent"`, entities[0].Reason)
+	assert.Equal(t, 3, entities[0].Sightings)
+	assert.Equal(t, "", entities[0].Src)
+	assert.Equal(t, "multi\nline", entities[1].Reason)
+}
+
+func TestCSVSerializerFormulaEscape(t *testing.T) {
+	ser, err := badman.NewCSVSerializer(badman.CSVColumnName, badman.CSVColumnReason)
+	require.NoError(t, err)
+
+	reasons := []string{"=HYPERLINK(\"http://example.com\")", "+1", "-1", "@SUM(A1)", "\tcmd", "'=quoted", "'plain", "plain"}
+	var src []*badman.BadEntity
+	for _, reason := range reasons {
+		src = append(src, &badman.BadEntity{Name: "blue.example.com", Reason: reason})
+	}
+
+	out := serializeCSV(t, ser, src...)
+	assert.Equal(t, "name,reason\r\n"+
+		"blue.example.com,\"'=HYPERLINK(\"\"http://example.com\"\")\"\r\n"+
+		"blue.example.com,'+1\r\n"+
+		"blue.example.com,'-1\r\n"+
+		"blue.example.com,'@SUM(A1)\r\n"+
+		"blue.example.com,'\tcmd\r\n"+
+		"blue.example.com,''=quoted\r\n"+
+		"blue.example.com,'plain\r\n"+
+		"blue.example.com,plain\r\n", out)
+
+	// Escaped values are restored by Deserialize.
+	entities, err := deserializeCSV(ser, out)
+	require.NoError(t, err)
+	require.Equal(t, len(reasons), len(entities))
+	for i, reason := range reasons {
+		assert.Equal(t, reason, entities[i].Reason)
+	}
+
+	t.Run("disabled", func(tt *testing.T) {
+		ser.SetFormulaEscape(false)
+		out := serializeCSV(tt, ser, &badman.BadEntity{Name: "blue.example.com", Reason: "=1+1"})
+		assert.Equal(tt, "name,reason\r\nblue.example.com,=1+1\r\n", out)
+
+		entities, err := deserializeCSV(ser, "name,reason\r\nblue.example.com,'=1+1\r\n")
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(entities))
+		assert.Equal(tt, "'=1+1", entities[0].Reason)
+	})
+}
+
+func TestTSVSerializerAllColumns(t *testing.T) {
+	ser, err := badman.NewTSVSerializer(
+		badman.CSVColumnName,
+		badman.CSVColumnKind,
+		badman.CSVColumnSource,
+		badman.CSVColumnReason,
+		badman.CSVColumnSavedAt,
+		badman.CSVColumnExpiresAt,
+		badman.CSVColumnFirstSeen,
+		badman.CSVColumnLastSeen,
+		badman.CSVColumnSightings,
+	)
+	require.NoError(t, err)
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	entity := &badman.BadEntity{
+		Name:      "192.0.2.0/24",
+		Kind:      badman.KindCIDR,
+		Src:       "tester",
+		Reason:    "scanner",
+		SavedAt:   now,
+		ExpiresAt: now.Add(time.Hour),
+		FirstSeen: now.Add(-time.Hour),
+		LastSeen:  now,
+		Sightings: 2,
+	}
+	out := serializeCSV(t, ser, entity)
+	lines := strings.Split(out, "\n")
+	assert.Equal(t, "name\tkind\tsource\treason\tsaved_at\texpires_at\tfirst_seen\tlast_seen\tsightings", lines[0])
+
+	entities, err := deserializeCSV(ser, out)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entities))
+	assert.Equal(t, *entity, *entities[0])
+}
+
+func TestCSVSerializerDeserialize(t *testing.T) {
+	ser, err := badman.NewCSVSerializer()
+	require.NoError(t, err)
+
+	t.Run("columns by header row", func(tt *testing.T) {
+		entities, err := deserializeCSV(ser, "comment,source,name\nignored,tester,blue.example.com\n")
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(entities))
+		assert.Equal(tt, "blue.example.com", entities[0].Name)
+		assert.Equal(tt, "tester", entities[0].Src)
+	})
+
+	t.Run("empty", func(tt *testing.T) {
+		entities, err := deserializeCSV(ser, "")
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(entities))
+	})
+
+	t.Run("no name column", func(tt *testing.T) {
+		_, err := deserializeCSV(ser, "source,reason\ntester,phishing\n")
+		assert.Error(tt, err)
+	})
+
+	t.Run("invalid time", func(tt *testing.T) {
+		_, err := deserializeCSV(ser, "name,saved_at\nblue.example.com,yesterday\n")
+		assert.Error(tt, err)
+	})
+
+	t.Run("wrong number of fields", func(tt *testing.T) {
+		_, err := deserializeCSV(ser, "name,source\nblue.example.com\n")
+		assert.Error(tt, err)
+	})
+}
+
+func TestCSVSerializerInvalidColumn(t *testing.T) {
+	_, err := badman.NewCSVSerializer(badman.CSVColumnName, "unknown")
+	assert.Error(t, err)
+	_, err = badman.NewTSVSerializer(badman.CSVColumnName, badman.CSVColumnName)
+	assert.Error(t, err)
+}
+
+func TestDumpAndLoadCSV(t *testing.T) {
+	ser, err := badman.NewCSVSerializer()
+	require.NoError(t, err)
+
+	man := newDumpTestBadMan(t, 3)
+	man.ReplaceSerializer(ser)
+	buf := &bytes.Buffer{}
+	require.NoError(t, man.Dump(buf))
+
+	// Output is plain CSV without dump header.
+	assert.True(t, strings.HasPrefix(buf.String(), "name,kind,source,reason,saved_at\r\n"))
+
+	man2 := badman.New()
+	man2.ReplaceSerializer(ser)
+	require.NoError(t, man2.Load(buf))
+	assert.Equal(t, 3, countAll(t, man2))
+}
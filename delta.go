@@ -0,0 +1,482 @@
+package badman
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// checksumPrefix is head of repository checksum to indicate the algorithm. v2 includes Kind in entityDigest.
+const checksumPrefix = "v2:"
+
+const (
+	// deltaExpiryBucket is default seconds of ExpiresAt bucket to group checksums of delta.
+	deltaExpiryBucket int64 = 3600
+	// deltaMaxBuckets is max number of buckets in DeltaHeader. Bucket is enlarged until number of buckets is within it to keep size of header.
+	deltaMaxBuckets = 1024
+	// neverExpiresBucket is bucket of entities that have no ExpiresAt. It is larger than any bucket, then it is always compared.
+	neverExpiresBucket int64 = math.MaxInt64
+)
+
+var (
+	// ErrDeltaBaseMismatch means that repository is not base of the delta. The repository is not changed and a full dump should be loaded instead of the delta.
+	ErrDeltaBaseMismatch = errors.New("Repository is not base of the delta")
+	// ErrDeltaPartiallyApplied means that applying the delta failed after the repository was changed. The repository is neither base nor target of the delta, and it must be reloaded by a full dump.
+	ErrDeltaPartiallyApplied = errors.New("Delta is partially applied, reload a full dump")
+)
+
+// DeltaHeader is metadata of delta in DumpHeader. Serialized data of delta has Added + Updated entities to be put at first, and then Removed entities that have only Name and Src.
+type DeltaHeader struct {
+	// BaseChecksum is checksum of repository that the delta is applied to, at the time the delta was created. It is informational, Load verifies the delta by BaseChecksums.
+	BaseChecksum string `json:"base_checksum"`
+	// TargetChecksum is checksum of repository after the delta is applied, at the time the delta was created. It is informational, Load verifies the delta by TargetChecksums.
+	TargetChecksum string `json:"target_checksum"`
+
+	// ExpiryBucket is seconds to group entities by ExpiresAt. BaseChecksums and TargetChecksums have checksum of each group, and the key is ExpiresAt (Unix time) divided by ExpiryBucket. Entities without ExpiresAt are grouped by math.MaxInt64. Load compares only groups after current bucket, then entities that expire between creating and loading the delta do not break the verification.
+	ExpiryBucket    int64            `json:"expiry_bucket"`
+	BaseChecksums   map[int64]string `json:"base_checksums"`
+	TargetChecksums map[int64]string `json:"target_checksums"`
+
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Removed int `json:"removed"`
+}
+
+// entityDigest returns hash of fields of entity that are compared by delta and checksum: Name, Src, Kind, Reason and ExpiresAt (in seconds). SavedAt, FirstSeen, LastSeen and Sightings are history of each repository and not compared.
+func entityDigest(entity *BadEntity) [sha256.Size]byte {
+	// Write of hash.Hash never returns an error.
+	h := sha256.New()
+	for _, s := range []string{entity.Name, entity.Src, string(entity.Kind), entity.Reason} {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(s)))
+		_, _ = io.WriteString(h, s)
+	}
+	var expiresAt int64
+	if !entity.ExpiresAt.IsZero() {
+		expiresAt = entity.ExpiresAt.Unix()
+	}
+	_ = binary.Write(h, binary.BigEndian, expiresAt)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// entityChecksum is order independent checksum of entities: sum of entityDigest modulo 2^256.
+type entityChecksum [4]uint64
+
+// add64 returns sum with carry of a, b and carry. It is same with math/bits.Add64 that is not available before Go 1.12.
+func add64(a, b, carry uint64) (uint64, uint64) {
+	sum := a + b + carry
+	return sum, ((a & b) | ((a | b) &^ sum)) >> 63
+}
+
+func (x *entityChecksum) add(digest [sha256.Size]byte) {
+	var carry uint64
+	for i := 3; i >= 0; i-- {
+		x[i], carry = add64(x[i], binary.BigEndian.Uint64(digest[i*8:]), carry)
+	}
+}
+
+func (x *entityChecksum) merge(other *entityChecksum) {
+	var carry uint64
+	for i := 3; i >= 0; i-- {
+		x[i], carry = add64(x[i], other[i], carry)
+	}
+}
+
+func (x *entityChecksum) String() string {
+	var raw [32]byte
+	for i, v := range x {
+		binary.BigEndian.PutUint64(raw[i*8:], v)
+	}
+	return checksumPrefix + hex.EncodeToString(raw[:])
+}
+
+func parseEntityChecksum(s string) (*entityChecksum, error) {
+	if !strings.HasPrefix(s, checksumPrefix) {
+		return nil, errors.Errorf("Unsupported checksum: %s", s)
+	}
+	raw, err := hex.DecodeString(s[len(checksumPrefix):])
+	if err != nil || len(raw) != 32 {
+		return nil, errors.Errorf("Invalid checksum: %s", s)
+	}
+	var sum entityChecksum
+	for i := range sum {
+		sum[i] = binary.BigEndian.Uint64(raw[i*8:])
+	}
+	return &sum, nil
+}
+
+// expiryBucketOf returns bucket of unix time t. It rounds down also for negative time.
+func expiryBucketOf(t, bucket int64) int64 {
+	k := t / bucket
+	if t%bucket < 0 {
+		k--
+	}
+	return k
+}
+
+// expiryChecksums is entityChecksum grouped by bucket of ExpiresAt.
+type expiryChecksums map[int64]*entityChecksum
+
+func (x expiryChecksums) add(entity *BadEntity, digest [sha256.Size]byte, bucket int64) {
+	key := neverExpiresBucket
+	if !entity.ExpiresAt.IsZero() {
+		key = expiryBucketOf(entity.ExpiresAt.Unix(), bucket)
+	}
+	sum, ok := x[key]
+	if !ok {
+		sum = &entityChecksum{}
+		x[key] = sum
+	}
+	sum.add(digest)
+}
+
+// enlarge merges groups into buckets that are double size.
+func (x expiryChecksums) enlarge() expiryChecksums {
+	merged := make(expiryChecksums)
+	for key, sum := range x {
+		if key != neverExpiresBucket {
+			key = expiryBucketOf(key, 2)
+		}
+		if _, ok := merged[key]; !ok {
+			merged[key] = &entityChecksum{}
+		}
+		merged[key].merge(sum)
+	}
+	return merged
+}
+
+// after returns checksum of groups after the cutoff bucket.
+func (x expiryChecksums) after(cutoff int64) *entityChecksum {
+	var sum entityChecksum
+	for key, s := range x {
+		if key > cutoff {
+			sum.merge(s)
+		}
+	}
+	return &sum
+}
+
+func (x expiryChecksums) strings() map[int64]string {
+	m := make(map[int64]string, len(x))
+	for key, sum := range x {
+		m[key] = sum.String()
+	}
+	return m
+}
+
+func parseExpiryChecksums(m map[int64]string) (expiryChecksums, error) {
+	x := make(expiryChecksums, len(m))
+	for key, s := range m {
+		sum, err := parseEntityChecksum(s)
+		if err != nil {
+			return nil, err
+		}
+		x[key] = sum
+	}
+	return x, nil
+}
+
+// entityKey identifies an entity in repository by Name and Src.
+func entityKey(entity *BadEntity) string {
+	return entity.Name + "\x00" + entity.Src
+}
+
+// repositoryChecksum calculates checksum of all entities in repo by Dump.
+func repositoryChecksum(ctx context.Context, repo Repository) (string, error) {
+	ch := withContext(repo).DumpContext(ctx)
+	if ch == nil {
+		return "", fmt.Errorf("This repository does not support Dump()")
+	}
+
+	var sum entityChecksum
+	for q := range ch {
+		if q.Error != nil {
+			return "", q.Error
+		}
+		for _, entity := range q.Entities {
+			sum.add(entityDigest(entity))
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return sum.String(), nil
+}
+
+// repositoryExpiryChecksums calculates checksums of entities in repo grouped by bucket of ExpiresAt, and returns them with current bucket after the Dump. Groups up to the current bucket may have entities that expired during Dump and should not be compared.
+func repositoryExpiryChecksums(ctx context.Context, repo Repository, bucket int64) (expiryChecksums, int64, error) {
+	ch := withContext(repo).DumpContext(ctx)
+	if ch == nil {
+		return nil, 0, fmt.Errorf("This repository does not support Dump()")
+	}
+
+	sums := make(expiryChecksums)
+	for q := range ch {
+		if q.Error != nil {
+			return nil, 0, q.Error
+		}
+		for _, entity := range q.Entities {
+			sums.add(entity, entityDigest(entity), bucket)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return sums, expiryBucketOf(time.Now().Unix(), bucket), nil
+}
+
+// Checksum returns checksum of entities in repository. It does not depend on order of entities and type of repository, then it can be compared with checksum of other repository. Name, Src, Kind, Reason and ExpiresAt of entities are compared. Note that expired entities are excluded, then the checksum changes when an entity expires.
+func (x *BadMan) Checksum() (string, error) {
+	return x.ChecksumContext(context.Background())
+}
+
+// ChecksumContext is same with Checksum, but it can be cancelled by ctx.
+func (x *BadMan) ChecksumContext(ctx context.Context) (string, error) {
+	return repositoryChecksum(ctx, x.repository())
+}
+
+// DumpDelta outputs delta from base repository to current repository into w. The delta has entities that are added, updated (Kind, Reason or ExpiresAt is changed) and removed, and it can be applied to a repository that has same entities with base by Load. Serializer must implement FormatSerializer. The delta is signed if signing key is set.
+func (x *BadMan) DumpDelta(w io.Writer, base Repository) error {
+	return x.DumpDeltaContext(context.Background(), w, base)
+}
+
+// DumpDeltaContext is same with DumpDelta, but it can be cancelled by ctx.
+func (x *BadMan) DumpDeltaContext(ctx context.Context, w io.Writer, base Repository) error {
+	ser, ok := x.ser.(FormatSerializer)
+	if !ok {
+		return errors.New("Fail to dump delta, Serializer must implement FormatSerializer")
+	}
+
+	// Index of base is kept in memory to find changes: digest of each entity.
+	index := make(map[string][sha256.Size]byte)
+	removed := make(map[string]*BadEntity)
+	delta := &DeltaHeader{}
+
+	baseCh := withContext(base).DumpContext(ctx)
+	if baseCh == nil {
+		return fmt.Errorf("Base repository does not support Dump()")
+	}
+	var baseSum entityChecksum
+	baseSums := make(expiryChecksums)
+	for q := range baseCh {
+		if q.Error != nil {
+			return errors.Wrap(q.Error, "Fail to dump base repository")
+		}
+		for _, entity := range q.Entities {
+			digest := entityDigest(entity)
+			baseSum.add(digest)
+			baseSums.add(entity, digest, deltaExpiryBucket)
+			key := entityKey(entity)
+			index[key] = digest
+			removed[key] = &BadEntity{Name: entity.Name, Src: entity.Src}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	delta.BaseChecksum = baseSum.String()
+
+	// Stop Dump of target when dump of delta fails in the middle.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	targetCh := withContext(x.repository()).DumpContext(ctx)
+	if targetCh == nil {
+		return fmt.Errorf("This repository does not support Dump()")
+	}
+
+	ch := make(chan *EntityQueue)
+	go func() {
+		defer close(ch)
+		var targetSum entityChecksum
+		targetSums := make(expiryChecksums)
+		for q := range targetCh {
+			if q.Error != nil {
+				ch <- q
+				drainEntityQueue(targetCh)
+				return
+			}
+
+			var changed []*BadEntity
+			for _, entity := range q.Entities {
+				digest := entityDigest(entity)
+				targetSum.add(digest)
+				targetSums.add(entity, digest, deltaExpiryBucket)
+				key := entityKey(entity)
+
+				baseDigest, exists := index[key]
+				delete(removed, key)
+				switch {
+				case !exists:
+					delta.Added++
+				case baseDigest != digest:
+					delta.Updated++
+				default:
+					continue
+				}
+				changed = append(changed, entity)
+			}
+			if len(changed) > 0 {
+				ch <- &EntityQueue{Entities: changed}
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		delta.TargetChecksum = targetSum.String()
+
+		bucket := deltaExpiryBucket
+		for len(baseSums)+len(targetSums) > deltaMaxBuckets {
+			baseSums, targetSums, bucket = baseSums.enlarge(), targetSums.enlarge(), bucket*2
+		}
+		delta.ExpiryBucket = bucket
+		delta.BaseChecksums = baseSums.strings()
+		delta.TargetChecksums = targetSums.strings()
+
+		var entities []*BadEntity
+		for _, entity := range removed {
+			entities = append(entities, entity)
+		}
+		delta.Removed = len(entities)
+		if len(entities) > 0 {
+			ch <- &EntityQueue{Entities: entities}
+		}
+	}()
+
+	if err := x.dumpWithHeader(ctx, ser, ch, &contextWriter{ctx: ctx, w: w}, nil, delta); err != nil {
+		cancel()
+		drainEntityQueue(ch)
+		return err
+	}
+	return nil
+}
+
+// deltaPatch is changes of a delta to be applied to repository. Changes are grouped by Name because Del of Repository removes entities of all sources.
+type deltaPatch struct {
+	header    *DeltaHeader
+	normalize func(entities []*BadEntity) []*BadEntity
+	// names has entities to be put by Src for each Name. nil entity means removal.
+	names map[string]map[string]*BadEntity
+	count int
+}
+
+func newDeltaPatch(header *DeltaHeader, normalize func(entities []*BadEntity) []*BadEntity) *deltaPatch {
+	return &deltaPatch{
+		header:    header,
+		normalize: normalize,
+		names:     make(map[string]map[string]*BadEntity),
+	}
+}
+
+// add records entities in order of serialized delta. The first Added + Updated entities are put and others are removed. Invalid entities are discarded by normalize.
+func (x *deltaPatch) add(entities []*BadEntity) {
+	for _, entity := range entities {
+		upsert := x.count < x.header.Added+x.header.Updated
+		x.count++
+		if len(x.normalize([]*BadEntity{entity})) == 0 {
+			continue
+		}
+
+		srcMap, ok := x.names[entity.Name]
+		if !ok {
+			srcMap = make(map[string]*BadEntity)
+			x.names[entity.Name] = srcMap
+		}
+		if upsert {
+			srcMap[entity.Src] = entity
+		} else {
+			srcMap[entity.Src] = nil
+		}
+	}
+}
+
+// verify checks that entities of repo match with checksums of the delta. Only groups after current bucket are compared on both sides, then entities expired after the delta was created are ignored.
+func (x *deltaPatch) verify(ctx context.Context, repo Repository, expected map[int64]string) (bool, error) {
+	if x.header.ExpiryBucket <= 0 {
+		return false, errors.New("Delta does not have ExpiryBucket, it is not supported")
+	}
+	sums, err := parseExpiryChecksums(expected)
+	if err != nil {
+		return false, errors.Wrap(err, "Fail to parse checksum of delta")
+	}
+	actual, cutoff, err := repositoryExpiryChecksums(ctx, repo, x.header.ExpiryBucket)
+	if err != nil {
+		return false, errors.Wrap(err, "Fail to calculate checksum of repository for delta")
+	}
+	return *sums.after(cutoff) == *actual.after(cutoff), nil
+}
+
+// apply changes repo by the delta after checking that repo has base of the delta. Entities of a changed Name are deleted and put again to replace them instead of merging. Changes are not atomic: an error wrapping ErrDeltaPartiallyApplied is returned if it fails after repo was changed.
+func (x *deltaPatch) apply(ctx context.Context, repo Repository) error {
+	matched, err := x.verify(ctx, repo, x.header.BaseChecksums)
+	if err != nil {
+		return err
+	}
+	if !matched {
+		return errors.Wrap(ErrDeltaBaseMismatch, "Fail to apply delta")
+	}
+
+	r := withContext(repo)
+	changed := false
+	for name, srcMap := range x.names {
+		existing, err := r.GetContext(ctx, name)
+		if err != nil {
+			return x.fail(changed, err, "Fail to get entities to apply delta: %s", name)
+		}
+
+		entities := make(map[string]*BadEntity)
+		for i := range existing {
+			entities[existing[i].Src] = &existing[i]
+		}
+		for src, entity := range srcMap {
+			if entity != nil {
+				entities[src] = entity
+			} else {
+				delete(entities, src)
+			}
+		}
+
+		changed = true
+		if err := r.DelContext(ctx, name); err != nil {
+			return x.fail(changed, err, "Fail to delete entities to apply delta: %s", name)
+		}
+		if len(entities) == 0 {
+			continue
+		}
+
+		var put []*BadEntity
+		for _, entity := range entities {
+			put = append(put, entity)
+		}
+		if err := r.PutContext(ctx, put); err != nil {
+			return x.fail(changed, err, "Fail to put entities to apply delta: %s", name)
+		}
+	}
+
+	matched, err = x.verify(ctx, repo, x.header.TargetChecksums)
+	if err != nil {
+		return x.fail(changed, err, "Fail to verify repository after applying delta")
+	}
+	if !matched {
+		return x.fail(changed, errors.New("checksum does not match"), "Delta is applied but repository is not target of the delta")
+	}
+	return nil
+}
+
+// fail wraps err by ErrDeltaPartiallyApplied if repository was changed.
+func (x *deltaPatch) fail(changed bool, err error, format string, args ...interface{}) error {
+	if !changed {
+		return errors.Wrapf(err, format, args...)
+	}
+	return errors.Wrapf(ErrDeltaPartiallyApplied, "%s: %v", fmt.Sprintf(format, args...), err)
+}
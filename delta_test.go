@@ -0,0 +1,263 @@
+package badman_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/badman"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func insertDeltaTestEntities(t *testing.T, man *badman.BadMan, entities []badman.BadEntity) {
+	for _, entity := range entities {
+		entity.SavedAt = time.Now()
+		require.NoError(t, man.Insert(entity))
+	}
+}
+
+var deltaBaseEntities = []badman.BadEntity{
+	{Name: "blue.example.com", Src: "src1"},
+	{Name: "orange.example.com", Src: "src1"},
+	{Name: "red.example.com", Src: "src1", Reason: "phishing"},
+	{Name: "10.1.2.3", Src: "src1"},
+	{Name: "10.1.2.3", Src: "src2"},
+	{Name: "192.0.2.0/24", Src: "src1"},
+}
+
+var deltaTargetEntities = []badman.BadEntity{
+	{Name: "blue.example.com", Src: "src1"},                      // unchanged
+	{Name: "red.example.com", Src: "src1", Reason: "malware"},    // updated
+	{Name: "10.1.2.3", Src: "src1"},                              // src2 is removed
+	{Name: "192.0.2.0/24", Src: "src1"},                          // unchanged
+	{Name: "198.51.100.0/24", Src: "src2"},                       // added
+	{Name: "green.example.com", Src: "src1", Reason: "phishing"}, // added
+}
+
+// setupDelta returns a consumer that has base entities and delta from base to target.
+func setupDelta(t *testing.T) (*badman.BadMan, *badman.BadMan, []byte) {
+	baseRepo := badman.NewInMemoryRepository()
+	base := badman.New()
+	base.ReplaceRepository(baseRepo)
+	insertDeltaTestEntities(t, base, deltaBaseEntities)
+	target := badman.New()
+	insertDeltaTestEntities(t, target, deltaTargetEntities)
+
+	// Consumer loads full dump of base.
+	buf := &bytes.Buffer{}
+	require.NoError(t, base.Dump(buf))
+	consumer := badman.New()
+	require.NoError(t, consumer.Load(buf))
+
+	delta := &bytes.Buffer{}
+	require.NoError(t, target.DumpDelta(delta, baseRepo))
+	return consumer, target, delta.Bytes()
+}
+
+func TestDeltaDump(t *testing.T) {
+	consumer, target, delta := setupDelta(t)
+
+	header, err := badman.ReadDumpHeader(bytes.NewReader(delta))
+	require.NoError(t, err)
+	require.NotNil(t, header.Delta)
+	assert.Equal(t, 2, header.Delta.Added)
+	assert.Equal(t, 1, header.Delta.Updated)
+	assert.Equal(t, 2, header.Delta.Removed)
+	assert.Equal(t, 5, header.Entities)
+
+	baseSum, err := consumer.Checksum()
+	require.NoError(t, err)
+	targetSum, err := target.Checksum()
+	require.NoError(t, err)
+	assert.Equal(t, baseSum, header.Delta.BaseChecksum)
+	assert.Equal(t, targetSum, header.Delta.TargetChecksum)
+
+	require.NoError(t, consumer.Load(bytes.NewReader(delta)))
+
+	sum, err := consumer.Checksum()
+	require.NoError(t, err)
+	assert.Equal(t, targetSum, sum)
+
+	entities, err := consumer.Lookup("orange.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entities))
+
+	entities, err = consumer.Lookup("red.example.com")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entities))
+	assert.Equal(t, "malware", entities[0].Reason)
+
+	entities, err = consumer.Lookup("10.1.2.3")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entities))
+	assert.Equal(t, "src1", entities[0].Src)
+	// Entity of unchanged source is replaced as is, not merged.
+	assert.Equal(t, 1, entities[0].Sightings)
+
+	entities, err = consumer.Lookup("198.51.100.1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+
+	t.Run("applied twice", func(tt *testing.T) {
+		assert.Error(tt, consumer.Load(bytes.NewReader(delta)))
+		sum, err := consumer.Checksum()
+		require.NoError(tt, err)
+		assert.Equal(tt, targetSum, sum)
+	})
+}
+
+func TestDeltaToOtherRepository(t *testing.T) {
+	_, _, delta := setupDelta(t)
+
+	man := badman.New()
+	insertDeltaTestEntities(t, man, deltaBaseEntities[1:])
+	before, err := man.Checksum()
+	require.NoError(t, err)
+
+	err = man.Load(bytes.NewReader(delta))
+	require.Error(t, err)
+	assert.Equal(t, badman.ErrDeltaBaseMismatch, errors.Cause(err))
+
+	after, err := man.Checksum()
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestDeltaExpiredEntity(t *testing.T) {
+	base := badman.NewInMemoryRepository()
+	consumer := badman.New()
+	consumer.ReplaceRepository(base)
+	insertDeltaTestEntities(t, consumer, deltaBaseEntities)
+	expiring := badman.BadEntity{Name: "expiring.example.com", Src: "src1", ExpiresAt: time.Now().Add(time.Second)}
+	insertDeltaTestEntities(t, consumer, []badman.BadEntity{expiring})
+
+	target := badman.New()
+	insertDeltaTestEntities(t, target, append(deltaTargetEntities, expiring))
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, target.DumpDelta(buf, base))
+
+	// The entity expires between creating and loading the delta.
+	time.Sleep(1100 * time.Millisecond)
+	require.NoError(t, consumer.Load(buf))
+
+	sum, err := consumer.Checksum()
+	require.NoError(t, err)
+	targetSum, err := target.Checksum()
+	require.NoError(t, err)
+	assert.Equal(t, targetSum, sum)
+}
+
+func TestDeltaPartiallyApplied(t *testing.T) {
+	base := badman.NewInMemoryRepository()
+	man := badman.New()
+	man.ReplaceRepository(base)
+	insertDeltaTestEntities(t, man, deltaBaseEntities)
+
+	target := badman.New()
+	insertDeltaTestEntities(t, target, deltaTargetEntities)
+	buf := &bytes.Buffer{}
+	require.NoError(t, target.DumpDelta(buf, base))
+
+	// Put fails after entities are deleted.
+	man.ReplaceRepository(&putErrorRepository{base})
+	err := man.Load(buf)
+	require.Error(t, err)
+	assert.Equal(t, badman.ErrDeltaPartiallyApplied, errors.Cause(err))
+}
+
+func TestDeltaNoChange(t *testing.T) {
+	base := badman.NewInMemoryRepository()
+	man := badman.New()
+	man.ReplaceRepository(base)
+	insertDeltaTestEntities(t, man, deltaBaseEntities)
+
+	target := badman.New()
+	insertDeltaTestEntities(t, target, deltaBaseEntities)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, target.DumpDelta(buf, base))
+
+	header, err := badman.ReadDumpHeader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, 0, header.Entities)
+	assert.Equal(t, header.Delta.BaseChecksum, header.Delta.TargetChecksum)
+	require.NoError(t, man.Load(buf))
+}
+
+func TestSignedDelta(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	base := badman.NewInMemoryRepository()
+	consumer := badman.New()
+	consumer.ReplaceRepository(base)
+	insertDeltaTestEntities(t, consumer, deltaBaseEntities)
+
+	target := badman.New()
+	target.SetSigningKey(priv)
+	insertDeltaTestEntities(t, target, deltaTargetEntities)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, target.DumpDelta(buf, base))
+
+	consumer.SetTrustedKeys(pub)
+	require.NoError(t, consumer.Load(buf))
+
+	sum, err := consumer.Checksum()
+	require.NoError(t, err)
+	targetSum, err := target.Checksum()
+	require.NoError(t, err)
+	assert.Equal(t, targetSum, sum)
+}
+
+func TestChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badman")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	repo, err := badman.NewBoltRepository(filepath.Join(dir, "badman.db"))
+	require.NoError(t, err)
+	defer repo.(io.Closer).Close()
+
+	man1 := badman.New()
+	insertDeltaTestEntities(t, man1, deltaBaseEntities)
+
+	// Checksum does not depend on order of entities, type of repository and time of insertion.
+	man2 := badman.New()
+	man2.ReplaceRepository(repo)
+	for i := len(deltaBaseEntities) - 1; i >= 0; i-- {
+		insertDeltaTestEntities(t, man2, deltaBaseEntities[i:i+1])
+	}
+
+	sum1, err := man1.Checksum()
+	require.NoError(t, err)
+	sum2, err := man2.Checksum()
+	require.NoError(t, err)
+	assert.Equal(t, sum1, sum2)
+
+	insertDeltaTestEntities(t, man2, []badman.BadEntity{{Name: "blue.example.com", Src: "src1", Reason: "changed"}})
+	sum3, err := man2.Checksum()
+	require.NoError(t, err)
+	assert.NotEqual(t, sum1, sum3)
+
+	t.Run("kind is compared", func(tt *testing.T) {
+		checksumOf := func(kind badman.EntityKind) string {
+			repo := badman.NewInMemoryRepository()
+			require.NoError(tt, repo.Put([]*badman.BadEntity{{Name: "10.1.2.3", Src: "src1", Kind: kind, SavedAt: time.Now()}}))
+			man := badman.New()
+			man.ReplaceRepository(repo)
+			sum, err := man.Checksum()
+			require.NoError(tt, err)
+			return sum
+		}
+		assert.NotEqual(tt, checksumOf(badman.KindIPv4), checksumOf(badman.KindDomain))
+	})
+}
@@ -0,0 +1,60 @@
+package badman
+
+import (
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// DomainMatchMode specifies how Lookup matches a domain name with entities of its parent domains.
+type DomainMatchMode int
+
+const (
+	// MatchExact matches only entities that have exactly same domain name. It's default mode.
+	MatchExact DomainMatchMode = iota
+	// MatchSubdomain matches also entities of parent domains, both of "example.com" and "*.example.com" for "a.example.com".
+	MatchSubdomain
+	// MatchWildcard matches also wildcard entities of parent domains, "*.example.com" for "a.example.com" but not "example.com".
+	MatchWildcard
+)
+
+const wildcardPrefix = "*."
+
+// parentDomains returns parent domain names of name from the nearest one. Public suffix (e.g. "com", "co.uk") is not included because an entity of public suffix should not match all domains under it.
+func parentDomains(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	base, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil || base == name {
+		return nil
+	}
+
+	var parents []string
+	for cur := name; cur != base; {
+		pos := strings.Index(cur, ".")
+		if pos < 0 {
+			break
+		}
+		cur = cur[pos+1:]
+		parents = append(parents, cur)
+	}
+
+	return parents
+}
+
+// domainCandidates returns names of entities that should be matched with name by mode except name itself.
+func domainCandidates(name string, mode DomainMatchMode) []string {
+	var candidates []string
+
+	switch mode {
+	case MatchSubdomain:
+		for _, parent := range parentDomains(name) {
+			candidates = append(candidates, parent, wildcardPrefix+parent)
+		}
+	case MatchWildcard:
+		for _, parent := range parentDomains(name) {
+			candidates = append(candidates, wildcardPrefix+parent)
+		}
+	}
+
+	return candidates
+}
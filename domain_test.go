@@ -0,0 +1,23 @@
+package badman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParentDomains(t *testing.T) {
+	assert.Equal(t, []string{"b.evil.example.com", "evil.example.com", "example.com"},
+		parentDomains("a.b.evil.example.com"))
+	assert.Equal(t, []string{"example.co.uk"}, parentDomains("blue.example.co.uk"))
+	assert.Equal(t, []string{"example.com"}, parentDomains("blue.example.com."))
+	assert.Nil(t, parentDomains("example.com"))
+	assert.Nil(t, parentDomains("co.uk"))
+	assert.Nil(t, parentDomains("com"))
+}
+
+func TestDomainCandidates(t *testing.T) {
+	assert.Nil(t, domainCandidates("a.example.com", MatchExact))
+	assert.Equal(t, []string{"example.com", "*.example.com"}, domainCandidates("a.example.com", MatchSubdomain))
+	assert.Equal(t, []string{"*.example.com"}, domainCandidates("a.example.com", MatchWildcard))
+}
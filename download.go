@@ -0,0 +1,328 @@
+package badman
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DownloadPolicy specifies behavior of Download when a source fails.
+type DownloadPolicy int
+
+const (
+	// FailFast aborts Download when any source fails. It's default policy.
+	FailFast DownloadPolicy = iota
+	// BestEffort continues Download with other sources when a source fails and returns error after all sources completed.
+	BestEffort
+)
+
+// SourceReport is result of download from one Source.
+type SourceReport struct {
+	Source Source
+	// Entities is number of entities that are received from Source and stored into repository.
+	Entities int
+	// Invalid is number of entities that are discarded because of invalid name.
+	Invalid  int
+	Duration time.Duration
+	Error    error
+	// Completed is true if download from Source finished, successfully or with Error. It's false if Download returned before the source finished, e.g. another source failed with FailFast policy, ctx was cancelled or repository failed. Entities and Duration of incomplete source are partial.
+	Completed bool
+
+	// srcs is Src of entities that are received from Source.
+	srcs map[string]struct{}
+}
+
+// knownSrcs returns Src of received entities and Srcs declared by SourceWithSrc.
+func (x *SourceReport) knownSrcs() map[string]struct{} {
+	srcs := make(map[string]struct{}, len(x.srcs))
+	for src := range x.srcs {
+		srcs[src] = struct{}{}
+	}
+	if s, ok := x.Source.(SourceWithSrc); ok {
+		for _, src := range s.Srcs() {
+			srcs[src] = struct{}{}
+		}
+	}
+	return srcs
+}
+
+// DownloadReport is result of Download. Sources has reports in same order with given Source set.
+type DownloadReport struct {
+	Sources []SourceReport
+}
+
+// SourceError is error of Download that summarizes errors of failed sources. Download returns it only when all other operations succeeded, then an error that is not SourceError (e.g. failure of repository) should not be ignored even with BestEffort policy.
+type SourceError struct {
+	// Failed is number of failed sources and Total is number of all sources.
+	Failed int
+	Total  int
+	msg    string
+}
+
+func (x *SourceError) Error() string {
+	return x.msg
+}
+
+// Err returns *SourceError that summarizes errors of failed sources. nil is returned if no source failed.
+func (x *DownloadReport) Err() error {
+	var msgs []string
+	for _, r := range x.Sources {
+		if r.Error != nil {
+			msgs = append(msgs, fmt.Sprintf("%T: %v", r.Source, r.Error))
+		}
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	return &SourceError{
+		Failed: len(msgs),
+		Total:  len(x.Sources),
+		msg:    fmt.Sprintf("Fail to download from %d source(s): %s", len(msgs), strings.Join(msgs, "; ")),
+	}
+}
+
+// sourceMessage is EntityQueue with index of source. queue is nil when the source completed download.
+type sourceMessage struct {
+	index int
+	queue *EntityQueue
+}
+
+// Download accesses blacklist data via Sources and store entities that is included in blacklist into repository.
+// If sync mode is enabled by SetSyncMode, entities that are not included in downloaded blacklists are deleted after all sources completed download. Src of a source is Src of its received entities and Srcs declared by SourceWithSrc. Entities of a Src are not deleted if a source of the Src failed or delivered no entity, e.g. a feed returned an empty list by outage. Nothing is deleted if a failed source sent no entity and does not implement SourceWithSrc.
+func (x *BadMan) Download(srcSet []Source) error {
+	_, err := x.DownloadWithReportContext(context.Background(), srcSet)
+	return err
+}
+
+// DownloadContext is same with Download, but it can be cancelled by ctx. Sources that implement SourceContext stop downloading when ctx is done.
+func (x *BadMan) DownloadContext(ctx context.Context, srcSet []Source) error {
+	_, err := x.DownloadWithReportContext(ctx, srcSet)
+	return err
+}
+
+// DownloadWithReport is same with Download, but also returns report of each source. With FailFast policy, sources that were still downloading at failure have Completed false in the report.
+func (x *BadMan) DownloadWithReport(srcSet []Source) (*DownloadReport, error) {
+	return x.DownloadWithReportContext(context.Background(), srcSet)
+}
+
+// DownloadWithReportContext is same with DownloadWithReport, but it can be cancelled by ctx.
+func (x *BadMan) DownloadWithReportContext(ctx context.Context, srcSet []Source) (*DownloadReport, error) {
+	return x.download(ctx, withContext(x.repository()), srcSet)
+}
+
+// Refresh downloads entities via srcSet into repo and then replaces current repository with repo atomically. repo should be a new empty repository. Lookup keeps using current repository until download completes, so that it never sees half-loaded data. If download fails, current repository is not replaced. Refresh is expected to be called in background goroutine of long-running service.
+func (x *BadMan) Refresh(repo Repository, srcSet []Source) error {
+	_, err := x.RefreshWithReportContext(context.Background(), repo, srcSet)
+	return err
+}
+
+// RefreshContext is same with Refresh, but it can be cancelled by ctx.
+func (x *BadMan) RefreshContext(ctx context.Context, repo Repository, srcSet []Source) error {
+	_, err := x.RefreshWithReportContext(ctx, repo, srcSet)
+	return err
+}
+
+// RefreshWithReportContext is same with RefreshContext, but also returns report of each source. With BestEffort policy, current repository is replaced if at least one source succeeded and Src of all failed sources is known (Src of received entities or declared by SourceWithSrc). Then entities of the failed sources' Src are copied from current repository into repo before the replacement, so that a failed source does not lose its entities until the next successful download. Current repository is not replaced if a failed source has unknown Src.
+func (x *BadMan) RefreshWithReportContext(ctx context.Context, repo Repository, srcSet []Source) (*DownloadReport, error) {
+	report, err := x.download(ctx, withContext(repo), srcSet)
+	if err != nil {
+		if _, ok := err.(*SourceError); !ok || x.policy == FailFast || !report.succeeded() {
+			return report, err
+		}
+		srcs, ok := report.failedSrcs()
+		if !ok {
+			return report, err
+		}
+		if cerr := copySrcEntities(ctx, x.repository(), repo, srcs); cerr != nil {
+			return report, errors.Wrap(cerr, "Fail to keep entities of failed sources for refresh")
+		}
+	}
+
+	x.ReplaceRepository(repo)
+	return report, err
+}
+
+// succeeded returns true if at least one source completed download without error.
+func (x *DownloadReport) succeeded() bool {
+	for _, r := range x.Sources {
+		if r.Completed && r.Error == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// failedSrcs returns Src of failed sources. false is returned if a failed source has unknown Src.
+func (x *DownloadReport) failedSrcs() (map[string]struct{}, bool) {
+	failed := map[string]struct{}{}
+	for i := range x.Sources {
+		r := &x.Sources[i]
+		if r.Error == nil {
+			continue
+		}
+		srcs := r.knownSrcs()
+		if len(srcs) == 0 {
+			return nil, false
+		}
+		for src := range srcs {
+			failed[src] = struct{}{}
+		}
+	}
+	return failed, true
+}
+
+// copySrcEntities puts entities of srcs in from into to.
+func copySrcEntities(ctx context.Context, from, to Repository, srcs map[string]struct{}) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := withContext(from).DumpContext(ctx)
+	if ch == nil {
+		return fmt.Errorf("Current repository does not support Dump()")
+	}
+	dst := withContext(to)
+	for q := range ch {
+		if q.Error != nil {
+			cancel()
+			drainEntityQueue(ch)
+			return q.Error
+		}
+
+		var entities []*BadEntity
+		for _, entity := range q.Entities {
+			if _, ok := srcs[entity.Src]; ok {
+				entities = append(entities, entity)
+			}
+		}
+		if len(entities) == 0 {
+			continue
+		}
+		if err := dst.PutContext(ctx, entities); err != nil {
+			cancel()
+			drainEntityQueue(ch)
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (x *BadMan) download(ctx context.Context, repo RepositoryContext, srcSet []Source) (*DownloadReport, error) {
+	startedAt := time.Now()
+	report := &DownloadReport{Sources: make([]SourceReport, len(srcSet))}
+
+	msgCh := make(chan *sourceMessage, 128)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for i := 0; i < len(srcSet); i++ {
+		report.Sources[i].Source = srcSet[i]
+		report.Sources[i].srcs = map[string]struct{}{}
+
+		go func(idx int, src Source) {
+			ch := download(ctx, src)
+			for q := range ch {
+				select {
+				case msgCh <- &sourceMessage{index: idx, queue: q}:
+				case <-ctx.Done():
+					// Drain the channel to let the source goroutine exit.
+					for range ch {
+					}
+					return
+				}
+			}
+
+			select {
+			case msgCh <- &sourceMessage{index: idx}:
+			case <-ctx.Done():
+			}
+		}(i, srcSet[i])
+	}
+
+	for closed := 0; closed < len(srcSet); {
+		var msg *sourceMessage
+		select {
+		case msg = <-msgCh:
+		case <-ctx.Done():
+			return report, errors.Wrap(ctx.Err(), "Download is cancelled")
+		}
+		r := &report.Sources[msg.index]
+
+		if msg.queue == nil {
+			// Duration of failed source is already set at the failure.
+			if r.Error == nil {
+				r.Duration = time.Since(startedAt)
+			}
+			r.Completed = true
+			closed++
+			continue
+		}
+		if r.Error != nil {
+			continue // Discard messages from the failed source
+		}
+
+		if msg.queue.Error != nil {
+			r.Error = msg.queue.Error
+			r.Duration = time.Since(startedAt)
+			r.Completed = true
+			if x.policy == FailFast {
+				return report, errors.Wrapf(msg.queue.Error, "Fail to download from source %T", srcSet[msg.index])
+			}
+			continue
+		}
+
+		entities := x.normalize(msg.queue.Entities)
+		if err := repo.PutContext(ctx, entities); err != nil {
+			return report, errors.Wrapf(err, "Fail to put downloaded entity: %v", msg.queue.Entities)
+		}
+
+		r.Entities += len(entities)
+		r.Invalid += len(msg.queue.Entities) - len(entities)
+		for _, entity := range entities {
+			r.srcs[entity.Src] = struct{}{}
+		}
+	}
+
+	if x.syncMode {
+		if err := prune(ctx, repo, report, startedAt); err != nil {
+			return report, err
+		}
+	}
+
+	return report, report.Err()
+}
+
+// prune deletes entities that were not seen since startedAt. Src of failed sources is excluded because their entities may not have been downloaded completely, and Src of sources that delivered no entity is also excluded because an empty feed is more likely an outage than an empty blacklist. Src of a source is Src of received entities and Srcs of SourceWithSrc. Nothing is pruned if a failed source has unknown Src, because the source may share Src with other sources.
+func prune(ctx context.Context, repo RepositoryContext, report *DownloadReport, startedAt time.Time) error {
+	targets := map[string]bool{}
+	for i := range report.Sources {
+		r := &report.Sources[i]
+		srcs := r.knownSrcs()
+		if r.Error != nil && len(srcs) == 0 {
+			return nil
+		}
+
+		for src := range srcs {
+			if _, ok := targets[src]; !ok {
+				targets[src] = true
+			}
+			if r.Error != nil || r.Entities == 0 {
+				targets[src] = false
+			}
+		}
+	}
+
+	for src, ok := range targets {
+		if !ok {
+			continue
+		}
+		if err := repo.PruneContext(ctx, src, startedAt); err != nil {
+			return errors.Wrapf(err, "Fail to prune entities of %s", src)
+		}
+	}
+
+	return nil
+}
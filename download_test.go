@@ -0,0 +1,423 @@
+package badman_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/badman"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// errorSource sends entities and then an error.
+type errorSource struct {
+	names []string
+}
+
+func (x *errorSource) Download() chan *badman.EntityQueue {
+	ch := make(chan *badman.EntityQueue)
+	go func() {
+		defer close(ch)
+		for _, name := range x.names {
+			ch <- &badman.EntityQueue{Entities: []*badman.BadEntity{
+				{Name: name, SavedAt: time.Now(), Src: "broken"},
+			}}
+		}
+		ch <- &badman.EntityQueue{Error: errors.New("feed is gone")}
+	}()
+	return ch
+}
+
+func TestDownloadFailFast(t *testing.T) {
+	man := badman.New()
+	healthy := &listSource{src: "healthy", names: []string{"blue.example.com"}}
+	broken := &errorSource{}
+
+	report, err := man.DownloadWithReport([]badman.Source{broken, healthy})
+	require.Error(t, err)
+	require.Equal(t, 2, len(report.Sources))
+	assert.Equal(t, broken, report.Sources[0].Source)
+	assert.Error(t, report.Sources[0].Error)
+	assert.True(t, report.Sources[0].Completed)
+
+	// Source that is still downloading at the failure is reported as not completed.
+	blocking := &blockingSource{stopped: make(chan struct{})}
+	report, err = man.DownloadWithReport([]badman.Source{broken, blocking})
+	require.Error(t, err)
+	assert.True(t, report.Sources[0].Completed)
+	assert.NoError(t, report.Sources[1].Error)
+	assert.False(t, report.Sources[1].Completed)
+}
+
+func TestDownloadBestEffort(t *testing.T) {
+	man := badman.New()
+	man.SetDownloadPolicy(badman.BestEffort)
+	healthy := &listSource{src: "healthy", names: []string{"blue.example.com", "orange.example.com", "not valid"}}
+	broken := &errorSource{names: []string{"red.example.com"}}
+
+	report, err := man.DownloadWithReport([]badman.Source{broken, healthy})
+	require.Error(t, err)
+	assert.EqualError(t, report.Err(), err.Error())
+	srcErr, ok := err.(*badman.SourceError)
+	require.True(t, ok)
+	assert.Equal(t, 1, srcErr.Failed)
+	assert.Equal(t, 2, srcErr.Total)
+	require.Equal(t, 2, len(report.Sources))
+
+	assert.Error(t, report.Sources[0].Error)
+	assert.Equal(t, 1, report.Sources[0].Entities)
+
+	assert.NoError(t, report.Sources[1].Error)
+	assert.True(t, report.Sources[1].Completed)
+	assert.Equal(t, 2, report.Sources[1].Entities)
+	assert.Equal(t, 1, report.Sources[1].Invalid)
+	assert.NotEqual(t, time.Duration(0), report.Sources[1].Duration)
+
+	entities, err := man.Lookup("orange.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+}
+
+func TestDownloadBestEffortSync(t *testing.T) {
+	man := badman.New()
+	man.SetDownloadPolicy(badman.BestEffort)
+	man.SetSyncMode(true)
+
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "old.example.com", Src: "broken"}))
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "old.example.com", Src: "healthy"}))
+
+	healthy := &listSource{src: "healthy", names: []string{"blue.example.com"}}
+	broken := &errorSource{names: []string{"red.example.com"}}
+	_, err := man.DownloadWithReport([]badman.Source{broken, healthy})
+	require.Error(t, err)
+
+	// Entity of failed source must not be pruned
+	entities, err := man.Lookup("old.example.com")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entities))
+	assert.Equal(t, "broken", entities[0].Src)
+}
+
+// putErrorRepository fails to put entities.
+type putErrorRepository struct {
+	badman.Repository
+}
+
+func (x *putErrorRepository) Put(entities []*badman.BadEntity) error {
+	return errors.New("repository is down")
+}
+
+func TestDownloadBestEffortRepositoryError(t *testing.T) {
+	man := badman.New()
+	man.SetDownloadPolicy(badman.BestEffort)
+	man.ReplaceRepository(&putErrorRepository{badman.NewInMemoryRepository()})
+
+	// Failure of repository is not SourceError even with BestEffort policy.
+	_, err := man.DownloadWithReport([]badman.Source{&listSource{src: "healthy", names: []string{"blue.example.com"}}})
+	require.Error(t, err)
+	_, ok := errors.Cause(err).(*badman.SourceError)
+	assert.False(t, ok)
+}
+
+// srcErrorSource fails without sending any entity and declares Src by SourceWithSrc. It closes the channel after delay.
+type srcErrorSource struct {
+	srcs  []string
+	delay time.Duration
+}
+
+func (x *srcErrorSource) Download() chan *badman.EntityQueue {
+	ch := make(chan *badman.EntityQueue)
+	go func() {
+		defer close(ch)
+		ch <- &badman.EntityQueue{Error: errors.New("feed is gone")}
+		time.Sleep(x.delay)
+	}()
+	return ch
+}
+
+func (x *srcErrorSource) Srcs() []string { return x.srcs }
+
+func TestDownloadBestEffortSyncSharedSrc(t *testing.T) {
+	setup := func(t *testing.T) *badman.BadMan {
+		man := badman.New()
+		man.SetDownloadPolicy(badman.BestEffort)
+		man.SetSyncMode(true)
+		require.NoError(t, man.Insert(badman.BadEntity{Name: "old.example.com", Src: "shared"}))
+		return man
+	}
+	healthy := &listSource{src: "shared", names: []string{"blue.example.com"}}
+
+	t.Run("failed source declares shared Src", func(tt *testing.T) {
+		man := setup(tt)
+		_, err := man.DownloadWithReport([]badman.Source{&srcErrorSource{srcs: []string{"shared"}}, healthy})
+		require.Error(tt, err)
+
+		entities, err := man.Lookup("old.example.com")
+		require.NoError(tt, err)
+		assert.Equal(tt, 1, len(entities))
+	})
+
+	t.Run("failed source has unknown Src", func(tt *testing.T) {
+		man := setup(tt)
+		_, err := man.DownloadWithReport([]badman.Source{&errorSource{}, healthy})
+		require.Error(tt, err)
+
+		entities, err := man.Lookup("old.example.com")
+		require.NoError(tt, err)
+		assert.Equal(tt, 1, len(entities))
+	})
+
+	t.Run("all sources succeeded", func(tt *testing.T) {
+		man := setup(tt)
+		require.NoError(tt, man.Download([]badman.Source{healthy}))
+
+		entities, err := man.Lookup("old.example.com")
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(entities))
+	})
+}
+
+// lateCloseSource fails and then waits for release before closing the channel. queued is closed when the error is queued into Download.
+type lateCloseSource struct {
+	queued  chan struct{}
+	release chan struct{}
+}
+
+func (x *lateCloseSource) Download() chan *badman.EntityQueue {
+	ch := make(chan *badman.EntityQueue)
+	go func() {
+		defer close(ch)
+		ch <- &badman.EntityQueue{Error: errors.New("feed is gone")}
+		// The error has been forwarded to Download when the next message is received.
+		ch <- &badman.EntityQueue{}
+		close(x.queued)
+		<-x.release
+	}()
+	return ch
+}
+
+// waitSource sends an entity after wait is closed.
+type waitSource struct {
+	wait chan struct{}
+}
+
+func (x *waitSource) Download() chan *badman.EntityQueue {
+	ch := make(chan *badman.EntityQueue)
+	go func() {
+		defer close(ch)
+		<-x.wait
+		ch <- &badman.EntityQueue{Entities: []*badman.BadEntity{{Name: "blue.example.com", Src: "healthy", SavedAt: time.Now()}}}
+	}()
+	return ch
+}
+
+// putHookRepository calls hook before Put.
+type putHookRepository struct {
+	badman.Repository
+	hook func()
+}
+
+func (x *putHookRepository) Put(entities []*badman.BadEntity) error {
+	x.hook()
+	return x.Repository.Put(entities)
+}
+
+// emptySource completes without any entity and declares Src by SourceWithSrc.
+type emptySource struct {
+	srcs []string
+}
+
+func (x *emptySource) Download() chan *badman.EntityQueue {
+	ch := make(chan *badman.EntityQueue)
+	close(ch)
+	return ch
+}
+
+func (x *emptySource) Srcs() []string { return x.srcs }
+
+func TestDownloadSyncEmptySource(t *testing.T) {
+	setup := func(t *testing.T) *badman.BadMan {
+		man := badman.New()
+		man.SetSyncMode(true)
+		require.NoError(t, man.Insert(badman.BadEntity{Name: "old.example.com", Src: "shared"}))
+		return man
+	}
+
+	t.Run("empty feed", func(tt *testing.T) {
+		man := setup(tt)
+		require.NoError(tt, man.Download([]badman.Source{&emptySource{srcs: []string{"shared"}}}))
+
+		entities, err := man.Lookup("old.example.com")
+		require.NoError(tt, err)
+		assert.Equal(tt, 1, len(entities))
+	})
+
+	t.Run("empty feed shares Src with healthy source", func(tt *testing.T) {
+		man := setup(tt)
+		healthy := &listSource{src: "shared", names: []string{"blue.example.com"}}
+		require.NoError(tt, man.Download([]badman.Source{&emptySource{srcs: []string{"shared"}}, healthy}))
+
+		entities, err := man.Lookup("old.example.com")
+		require.NoError(tt, err)
+		assert.Equal(tt, 1, len(entities))
+	})
+}
+
+func TestDownloadFailedSourceDuration(t *testing.T) {
+	// Order of events: the failure, Put of the healthy source and close of the failed source. Duration of failed source must be time until the failure, then it is shorter than time until the Put.
+	broken := &lateCloseSource{queued: make(chan struct{}), release: make(chan struct{})}
+	healthy := &waitSource{wait: broken.queued}
+
+	var putAt time.Time
+	man := badman.New()
+	man.SetDownloadPolicy(badman.BestEffort)
+	man.ReplaceRepository(&putHookRepository{
+		Repository: badman.NewInMemoryRepository(),
+		hook: func() {
+			putAt = time.Now()
+			// Delay the close so that overwriting Duration at the close is detected.
+			time.Sleep(20 * time.Millisecond)
+			close(broken.release)
+		},
+	})
+
+	calledAt := time.Now()
+	report, err := man.DownloadWithReport([]badman.Source{broken, healthy})
+	require.Error(t, err)
+	require.True(t, report.Sources[0].Completed)
+	assert.True(t, report.Sources[0].Duration <= putAt.Sub(calledAt), report.Sources[0].Duration)
+}
+
+// blockingSource sends nothing until ctx is done.
+type blockingSource struct {
+	stopped chan struct{}
+}
+
+func (x *blockingSource) Download() chan *badman.EntityQueue {
+	return x.DownloadContext(context.Background())
+}
+
+func (x *blockingSource) DownloadContext(ctx context.Context) chan *badman.EntityQueue {
+	ch := make(chan *badman.EntityQueue)
+	go func() {
+		defer close(x.stopped)
+		defer close(ch)
+		<-ctx.Done()
+	}()
+	return ch
+}
+
+func TestDownloadContextCancel(t *testing.T) {
+	man := badman.New()
+	src := &blockingSource{stopped: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := man.DownloadContext(ctx, []badman.Source{src})
+	require.Error(t, err)
+
+	select {
+	case <-src.stopped:
+	case <-time.After(time.Second):
+		require.Fail(t, "Source goroutine is still running")
+	}
+}
+
+func TestLookupContextCancel(t *testing.T) {
+	man := badman.New()
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "blue.example.com", Src: "tester"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := man.LookupContext(ctx, "blue.example.com")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestRefresh(t *testing.T) {
+	man := badman.New()
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "old.example.com", Src: "healthy"}))
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// Either old or new repository must be seen, never empty one. The swap is one way, then same result of old.example.com before and after looking up blue.example.com means that all lookups saw same repository.
+			old, err := man.Lookup("old.example.com")
+			assert.NoError(t, err)
+			blue, err := man.Lookup("blue.example.com")
+			assert.NoError(t, err)
+			again, err := man.Lookup("old.example.com")
+			assert.NoError(t, err)
+			if len(old) != len(again) {
+				continue // Repository was swapped between lookups
+			}
+			assert.Equal(t, 1, len(old)+len(blue))
+		}
+	}()
+
+	healthy := &listSource{src: "healthy", names: []string{"blue.example.com"}}
+	require.NoError(t, man.Refresh(badman.NewInMemoryRepository(), []badman.Source{healthy}))
+	close(done)
+	wg.Wait()
+
+	entities, err := man.Lookup("old.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entities))
+	entities, err = man.Lookup("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+}
+
+func TestRefreshFailure(t *testing.T) {
+	man := badman.New()
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "old.example.com", Src: "healthy"}))
+
+	broken := &errorSource{names: []string{"red.example.com"}}
+	require.Error(t, man.Refresh(badman.NewInMemoryRepository(), []badman.Source{broken}))
+
+	entities, err := man.Lookup("old.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+	entities, err = man.Lookup("red.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entities))
+
+	man.SetDownloadPolicy(badman.BestEffort)
+	healthy := &listSource{src: "healthy", names: []string{"blue.example.com"}}
+
+	// BestEffort does not replace repository if a failed source has unknown Src because its entities can not be kept.
+	_, err = man.RefreshWithReportContext(context.Background(), badman.NewInMemoryRepository(), []badman.Source{&srcErrorSource{}, healthy})
+	require.Error(t, err)
+	entities, err = man.Lookup("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entities))
+
+	// BestEffort replaces repository if any source succeeded, and keeps entities of Src of failed sources.
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "old-broken.example.com", Src: "broken"}))
+	report, err := man.RefreshWithReportContext(context.Background(), badman.NewInMemoryRepository(), []badman.Source{broken, healthy})
+	require.Error(t, err)
+	_, ok := err.(*badman.SourceError)
+	assert.True(t, ok)
+	require.Equal(t, 2, len(report.Sources))
+
+	entities, err = man.Lookup("old.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entities))
+	entities, err = man.Lookup("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+	entities, err = man.Lookup("old-broken.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+}
@@ -0,0 +1,215 @@
+package badman
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dumpMagic is head of serialized data that has DumpHeader. It starts with non-ASCII byte so that it's never confused with JSON, MessagePack map or gzip of legacy dump.
+var dumpMagic = []byte("\x89BADMAN\n")
+
+const (
+	// dumpHeaderVersion is version of DumpHeader format. It must be incremented when a change of the format breaks older readers. Version 2 has embedded signature in a block after the header to sign the header as written.
+	dumpHeaderVersion = 2
+	// dumpHeaderMaxSize limits size of DumpHeader not to allocate huge memory by broken data.
+	dumpHeaderMaxSize = 1 << 20
+)
+
+// Encodings and compressions of DumpFormat for built-in Serializers.
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// DumpFormat identifies a Serializer in DumpHeader.
+type DumpFormat struct {
+	Encoding    string `json:"encoding"`
+	Compression string `json:"compression"`
+	// Encryption is encryption algorithm of EncryptedSerializer. It's empty if the data is not encrypted.
+	Encryption string `json:"encryption,omitempty"`
+}
+
+// FormatSerializer is Serializer that can be identified by DumpFormat. Dump writes DumpHeader only if Serializer implements FormatSerializer, and Load selects a built-in Serializer by DumpFormat in DumpHeader.
+type FormatSerializer interface {
+	Serializer
+	Format() DumpFormat
+}
+
+// DumpHeader is metadata that is written before serialized entities by Dump.
+type DumpHeader struct {
+	Version int `json:"version"`
+	DumpFormat
+	CreatedAt time.Time `json:"created_at"`
+	// Entities is number of serialized entities. Load fails if number of loaded entities is different, e.g. the data is truncated.
+	Entities int `json:"entities"`
+	// Digest is hash of serialized entities after DumpHeader, e.g. "sha256:0123...". Load fails if it does not match the data.
+	Digest string `json:"digest,omitempty"`
+	// Signature is embedded DumpSignature. It's nil if the data is not signed or signed with detached signature. It is written in a block after the header JSON because the signature covers the header JSON as written.
+	Signature *DumpSignature `json:"-"`
+	// Delta is set if the data is delta that is output by DumpDelta.
+	Delta *DeltaHeader `json:"delta,omitempty"`
+
+	// raw is the header JSON as written or read, and it is the signed message.
+	raw []byte
+}
+
+// marshalDumpHeader encodes header to JSON and keeps it as the message to be signed and written.
+func marshalDumpHeader(header *DumpHeader) error {
+	raw, err := json.Marshal(header)
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal dump header")
+	}
+	header.raw = raw
+	return nil
+}
+
+// builtinSerializer returns a built-in Serializer of format. nil is returned if format is unknown.
+func builtinSerializer(format DumpFormat) Serializer {
+	for _, ser := range []FormatSerializer{
+		NewJSONSerializer(),
+		NewGzipJSONSerializer(),
+		NewMsgpackSerializer(),
+		NewGzipMsgpackSerializer(),
+	} {
+		if ser.Format() == format {
+			return ser
+		}
+	}
+	return nil
+}
+
+// writeDumpHeader writes dumpMagic, version (uint16), length of header (uint32), header as JSON that is encoded by marshalDumpHeader, length of embedded signature (uint32, 0 if no signature) and the signature as JSON.
+func writeDumpHeader(w io.Writer, header *DumpHeader) error {
+	if header.raw == nil {
+		return errors.New("Fail to write dump header, it is not marshaled")
+	}
+	var sig []byte
+	if header.Signature != nil {
+		raw, err := json.Marshal(header.Signature)
+		if err != nil {
+			return errors.Wrap(err, "Fail to marshal dump signature")
+		}
+		sig = raw
+	}
+
+	var buf bytes.Buffer
+	if _, err := buf.Write(dumpMagic); err != nil {
+		return errors.Wrap(err, "Fail to write dump header")
+	}
+	if err := binary.Write(&buf, binary.BigEndian, uint16(header.Version)); err != nil {
+		return errors.Wrap(err, "Fail to write dump header")
+	}
+	for _, block := range [][]byte{header.raw, sig} {
+		if err := binary.Write(&buf, binary.BigEndian, uint32(len(block))); err != nil {
+			return errors.Wrap(err, "Fail to write dump header")
+		}
+		if _, err := buf.Write(block); err != nil {
+			return errors.Wrap(err, "Fail to write dump header")
+		}
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return errors.Wrap(err, "Fail to write dump header")
+	}
+	return nil
+}
+
+// ReadDumpHeader reads DumpHeader from head of r. nil and no error are returned if r does not start with DumpHeader, e.g. data by older version of Dump. Note that r is read beyond DumpHeader because of buffering.
+func ReadDumpHeader(r io.Reader) (*DumpHeader, error) {
+	return readDumpHeader(bufio.NewReader(r))
+}
+
+// readDumpBlock reads length (uint32) and data of a block in DumpHeader.
+func readDumpBlock(br *bufio.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+		return nil, errors.Wrap(err, "Fail to read dump header")
+	}
+	if length > dumpHeaderMaxSize {
+		return nil, errors.Errorf("Fail to read dump header, too large: %d bytes", length)
+	}
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(br, raw); err != nil {
+		return nil, errors.Wrap(err, "Fail to read dump header")
+	}
+	return raw, nil
+}
+
+// readDumpHeader reads DumpHeader from br. br is not consumed if it does not start with dumpMagic.
+func readDumpHeader(br *bufio.Reader) (*DumpHeader, error) {
+	magic, err := br.Peek(len(dumpMagic))
+	if err != nil || !bytes.Equal(magic, dumpMagic) {
+		// Short data is also regarded as legacy dump and left to Serializer.
+		return nil, nil
+	}
+	if _, err := br.Discard(len(dumpMagic)); err != nil {
+		return nil, errors.Wrap(err, "Fail to read dump header")
+	}
+
+	var version uint16
+	if err := binary.Read(br, binary.BigEndian, &version); err != nil {
+		return nil, errors.Wrap(err, "Fail to read dump header")
+	}
+	if version != dumpHeaderVersion {
+		return nil, errors.Errorf("Fail to read dump header, unsupported version: %d", version)
+	}
+
+	raw, err := readDumpBlock(br)
+	if err != nil {
+		return nil, err
+	}
+	var header DumpHeader
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, errors.Wrapf(err, "Fail to unmarshal dump header: %s", string(raw))
+	}
+	header.raw = raw
+
+	sig, err := readDumpBlock(br)
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) > 0 {
+		if err := json.Unmarshal(sig, &header.Signature); err != nil {
+			return nil, errors.Wrapf(err, "Fail to unmarshal dump signature: %s", string(sig))
+		}
+	}
+	return &header, nil
+}
+
+// countEntityQueue forwards messages from ch to returned channel and counts forwarded entities into count. count must not be read until returned channel is closed.
+func countEntityQueue(ch chan *EntityQueue, count *int) chan *EntityQueue {
+	out := make(chan *EntityQueue)
+	go func() {
+		defer close(out)
+		for q := range ch {
+			*count += len(q.Entities)
+			out <- q
+		}
+	}()
+	return out
+}
+
+func (x *JSONSerializer) Format() DumpFormat {
+	return DumpFormat{Encoding: EncodingJSON, Compression: CompressionNone}
+}
+
+func (x *GzipJSONSerializer) Format() DumpFormat {
+	return DumpFormat{Encoding: EncodingJSON, Compression: CompressionGzip}
+}
+
+func (x *MsgpackSerializer) Format() DumpFormat {
+	return DumpFormat{Encoding: EncodingMsgpack, Compression: CompressionNone}
+}
+
+func (x *GzipMsgpackSerializer) Format() DumpFormat {
+	return DumpFormat{Encoding: EncodingMsgpack, Compression: CompressionGzip}
+}
@@ -0,0 +1,213 @@
+package badman_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/badman"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDumpTestBadMan(t *testing.T, n int) *badman.BadMan {
+	man := badman.New()
+	for i := 0; i < n; i++ {
+		require.NoError(t, man.Insert(badman.BadEntity{
+			Name:    fmt.Sprintf("blue%d.example.com", i),
+			SavedAt: time.Now(),
+			Src:     "tester",
+		}))
+	}
+	return man
+}
+
+func TestDumpHeader(t *testing.T) {
+	man := newDumpTestBadMan(t, 3)
+	buf := &bytes.Buffer{}
+	require.NoError(t, man.Dump(buf))
+
+	header, err := badman.ReadDumpHeader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.NotNil(t, header)
+	assert.Equal(t, 2, header.Version)
+	assert.Equal(t, badman.EncodingMsgpack, header.Encoding)
+	assert.Equal(t, badman.CompressionGzip, header.Compression)
+	assert.Equal(t, 3, header.Entities)
+	assert.False(t, header.CreatedAt.IsZero())
+}
+
+func TestLoadAutoDetectSerializer(t *testing.T) {
+	serializers := []badman.Serializer{
+		badman.NewJSONSerializer(),
+		badman.NewGzipJSONSerializer(),
+		badman.NewMsgpackSerializer(),
+		badman.NewGzipMsgpackSerializer(),
+	}
+
+	for _, dumpSer := range serializers {
+		for _, loadSer := range serializers {
+			man := newDumpTestBadMan(t, 3)
+			man.ReplaceSerializer(dumpSer)
+			buf := &bytes.Buffer{}
+			require.NoError(t, man.Dump(buf))
+
+			man2 := badman.New()
+			man2.ReplaceSerializer(loadSer)
+			require.NoError(t, man2.Load(buf))
+
+			entities, err := man2.Lookup("blue1.example.com")
+			require.NoError(t, err)
+			require.Equal(t, 1, len(entities))
+			assert.Equal(t, "tester", entities[0].Src)
+		}
+	}
+}
+
+func TestLoadLegacyDump(t *testing.T) {
+	ser := badman.NewGzipJSONSerializer()
+	ch := make(chan *badman.EntityQueue, 1)
+	ch <- &badman.EntityQueue{Entities: []*badman.BadEntity{
+		{Name: "10.1.2.3", SavedAt: time.Now(), Src: "tester"},
+	}}
+	close(ch)
+
+	// Output of older version has no DumpHeader.
+	buf := &bytes.Buffer{}
+	require.NoError(t, ser.Serialize(ch, buf))
+
+	header, err := badman.ReadDumpHeader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Nil(t, header)
+
+	man := badman.New()
+	man.ReplaceSerializer(ser)
+	require.NoError(t, man.Load(buf))
+
+	entities, err := man.Lookup("10.1.2.3")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+}
+
+func TestLoadBrokenDumpHeader(t *testing.T) {
+	man := newDumpTestBadMan(t, 3)
+	man.ReplaceSerializer(badman.NewJSONSerializer())
+	buf := &bytes.Buffer{}
+	require.NoError(t, man.Dump(buf))
+	data := buf.Bytes()
+
+	t.Run("unsupported version", func(tt *testing.T) {
+		broken := append([]byte{}, data...)
+		broken[9] = 0xff // lower byte of version after 8 bytes magic
+		assert.Error(tt, badman.New().Load(bytes.NewReader(broken)))
+	})
+
+	t.Run("unsupported format", func(tt *testing.T) {
+		broken := bytes.Replace(data, []byte(`"encoding":"json"`), []byte(`"encoding":"xxxx"`), 1)
+		assert.Error(tt, badman.New().Load(bytes.NewReader(broken)))
+	})
+
+	t.Run("entity count mismatch", func(tt *testing.T) {
+		broken := bytes.Replace(data, []byte(`"entities":3`), []byte(`"entities":4`), 1)
+		assert.Error(tt, badman.New().Load(bytes.NewReader(broken)))
+	})
+}
+
+// plainSerializer is custom Serializer that does not implement FormatSerializer.
+type plainSerializer struct {
+	badman.Serializer
+}
+
+func TestDumpCustomSerializer(t *testing.T) {
+	man := newDumpTestBadMan(t, 2)
+	man.ReplaceSerializer(&plainSerializer{badman.NewJSONSerializer()})
+	buf := &bytes.Buffer{}
+	require.NoError(t, man.Dump(buf))
+
+	header, err := badman.ReadDumpHeader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Nil(t, header)
+
+	man2 := badman.New()
+	man2.ReplaceSerializer(&plainSerializer{badman.NewJSONSerializer()})
+	require.NoError(t, man2.Load(buf))
+	stats, err := man2.Count(badman.EntityFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Total)
+}
+
+func TestLoadDumpTwice(t *testing.T) {
+	man := newDumpTestBadMan(t, 3)
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "blue0.example.com", SavedAt: time.Now(), Src: "tester"}))
+	buf := &bytes.Buffer{}
+	require.NoError(t, man.Dump(buf))
+
+	// Sightings in dump are history, then loading same dump again does not double them.
+	man2 := badman.New()
+	require.NoError(t, man2.Load(bytes.NewReader(buf.Bytes())))
+	require.NoError(t, man2.Load(bytes.NewReader(buf.Bytes())))
+
+	entities, err := man2.Lookup("blue0.example.com")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entities))
+	assert.Equal(t, 2, entities[0].Sightings)
+}
+
+// brokenSerializer is FormatSerializer that fails after reading the first message.
+type brokenSerializer struct {
+	badman.FormatSerializer
+}
+
+func (x *brokenSerializer) Serialize(ch chan *badman.EntityQueue, w io.Writer) error {
+	<-ch
+	// Let the next message be forwarded to ch before failure.
+	time.Sleep(10 * time.Millisecond)
+	return errors.New("broken serializer")
+}
+
+func TestDumpSerializeFailure(t *testing.T) {
+	man := newDumpTestBadMan(t, 300)
+	man.ReplaceSerializer(&brokenSerializer{badman.NewJSONSerializer()})
+
+	// Goroutines that forward entities to Serializer must exit after Serialize failed.
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		assert.Error(t, man.Dump(&bytes.Buffer{}))
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= before, "%d goroutines remain", runtime.NumGoroutine()-before)
+}
+
+func TestLoadVerifyBeforePut(t *testing.T) {
+	man := newDumpTestBadMan(t, 3)
+	man.ReplaceSerializer(badman.NewJSONSerializer())
+	buf := &bytes.Buffer{}
+	require.NoError(t, man.Dump(buf))
+
+	t.Run("digest mismatch", func(tt *testing.T) {
+		tampered := bytes.Replace(buf.Bytes(), []byte("blue1.example.com"), []byte("blue9.example.com"), 1)
+		man2 := badman.New()
+		assert.Error(tt, man2.Load(bytes.NewReader(tampered)))
+		assert.Equal(tt, 0, countAll(tt, man2))
+	})
+
+	t.Run("number of entities mismatch", func(tt *testing.T) {
+		tampered := bytes.Replace(buf.Bytes(), []byte(`"entities":3`), []byte(`"entities":4`), 1)
+		require.NotEqual(tt, buf.Bytes(), tampered)
+		man2 := badman.New()
+		assert.Error(tt, man2.Load(bytes.NewReader(tampered)))
+		assert.Equal(tt, 0, countAll(tt, man2))
+	})
+
+	t.Run("valid", func(tt *testing.T) {
+		man2 := badman.New()
+		require.NoError(tt, man2.Load(bytes.NewReader(buf.Bytes())))
+		assert.Equal(tt, 3, countAll(tt, man2))
+	})
+}
@@ -0,0 +1,247 @@
+// Tests of dynamoRepository are internal unlike other tests because they inject fake DynamoDB clients into unexported fields (client, retryInterval) to test retries and requests without DynamoDB. Exporting a constructor that accepts a client only for testing is avoided. Tests against real DynamoDB or DynamoDB Local are in repository_test.go.
+
+package badman
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyDynamoClient returns half of requests as UnprocessedItems until failures reaches 0. It also returns stored items as result of BatchGetItem and records the requested keys.
+type flakyDynamoClient struct {
+	dynamodbiface.DynamoDBAPI
+	lock     sync.Mutex
+	failures int
+	batches  [][]*dynamodb.WriteRequest
+	items    []dynamoEntityItem
+	gets     []map[string]*dynamodb.AttributeValue
+}
+
+func (x *flakyDynamoClient) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	output := dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]*dynamodb.AttributeValue{}}
+	for table, keys := range input.RequestItems {
+		for _, key := range keys.Keys {
+			x.gets = append(x.gets, key)
+			for _, item := range x.items {
+				if item.Name != aws.StringValue(key["name"].S) || item.Src != aws.StringValue(key["src"].S) {
+					continue
+				}
+				attrs, err := dynamo.MarshalItem(item)
+				if err != nil {
+					return nil, err
+				}
+				output.Responses[table] = append(output.Responses[table], attrs)
+			}
+		}
+	}
+	return &output, nil
+}
+
+func (x *flakyDynamoClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	var output dynamodb.BatchWriteItemOutput
+	for table, requests := range input.RequestItems {
+		x.batches = append(x.batches, requests)
+		if x.failures > 0 && len(requests) > 1 {
+			x.failures--
+			output.UnprocessedItems = map[string][]*dynamodb.WriteRequest{
+				table: requests[len(requests)/2:],
+			}
+		}
+	}
+	return &output, nil
+}
+
+func newFlakyDynamoRepository(failures, maxRetries int) (*dynamoRepository, *flakyDynamoClient) {
+	client := &flakyDynamoClient{failures: failures}
+	repo := &dynamoRepository{
+		table:         dynamo.NewFromIface(client).Table("test-table"),
+		client:        client,
+		maxRetries:    maxRetries,
+		retryInterval: time.Millisecond,
+	}
+	return repo, client
+}
+
+func testDeleteKeys(n int) []dynamoEntityItem {
+	keys := make([]dynamoEntityItem, n)
+	for i := range keys {
+		keys[i] = dynamoEntityItem{Name: "blue.example.com", Src: string(rune('a' + i))}
+	}
+	return keys
+}
+
+func TestDynamoBatchDeleteChunk(t *testing.T) {
+	repo, client := newFlakyDynamoRepository(0, 3)
+	require.NoError(t, repo.batchDelete(context.Background(), testDeleteKeys(60)))
+
+	require.Equal(t, 3, len(client.batches))
+	assert.Equal(t, 25, len(client.batches[0]))
+	assert.Equal(t, 25, len(client.batches[1]))
+	assert.Equal(t, 10, len(client.batches[2]))
+}
+
+func TestDynamoBatchDeleteRetry(t *testing.T) {
+	repo, client := newFlakyDynamoRepository(2, 3)
+	require.NoError(t, repo.batchDelete(context.Background(), testDeleteKeys(20)))
+
+	// 20 items -> 10 unprocessed -> 5 unprocessed -> done
+	require.Equal(t, 3, len(client.batches))
+	assert.Equal(t, 20, len(client.batches[0]))
+	assert.Equal(t, 10, len(client.batches[1]))
+	assert.Equal(t, 5, len(client.batches[2]))
+}
+
+func TestDynamoBatchDeleteRetryExhausted(t *testing.T) {
+	repo, client := newFlakyDynamoRepository(10, 2)
+	assert.Error(t, repo.batchDelete(context.Background(), testDeleteKeys(20)))
+	assert.Equal(t, 3, len(client.batches))
+}
+
+func testWrittenItems(t *testing.T, client *flakyDynamoClient) map[string]dynamoEntityItem {
+	items := map[string]dynamoEntityItem{}
+	for _, batch := range client.batches {
+		for _, req := range batch {
+			require.NotNil(t, req.PutRequest)
+			var item dynamoEntityItem
+			require.NoError(t, dynamo.UnmarshalItem(req.PutRequest.Item, &item))
+			items[item.Name] = item
+		}
+	}
+	return items
+}
+
+func TestDynamoPutByBatch(t *testing.T) {
+	repo, client := newFlakyDynamoRepository(0, 3)
+
+	entities := []*BadEntity{
+		{Name: "fresh.example.com", Src: "tester", SavedAt: time.Now()},
+	}
+	for i := 0; i < 30; i++ {
+		entities = append(entities, &BadEntity{Name: fmt.Sprintf("%d.example.com", i), Src: "tester", SavedAt: time.Now(), Sightings: 3})
+	}
+	// Duplicated key is merged not to be rejected by BatchWriteItem.
+	entities = append(entities, &BadEntity{Name: "0.example.com", Src: "tester", SavedAt: time.Now(), Sightings: 5})
+	entities = append(entities, &BadEntity{Name: "fresh.example.com", Src: "tester", SavedAt: time.Now()})
+	require.NoError(t, repo.Put(entities))
+
+	assert.Equal(t, 31, len(client.gets))
+	require.Equal(t, 2, len(client.batches))
+	sizes := []int{len(client.batches[0]), len(client.batches[1])}
+	assert.ElementsMatch(t, []int{25, 6}, sizes)
+
+	items := testWrittenItems(t, client)
+	assert.Equal(t, 31, len(items))
+	assert.Equal(t, 5, items["0.example.com"].Sightings)
+	assert.Equal(t, 2, items["fresh.example.com"].Sightings)
+}
+
+func TestDynamoPutMergeExisting(t *testing.T) {
+	now := time.Now()
+	firstSeen := now.Add(-24 * time.Hour).UTC()
+
+	repo, client := newFlakyDynamoRepository(0, 3)
+	client.items = []dynamoEntityItem{
+		{Name: "alive.example.com", Src: "tester", SavedAt: firstSeen, ExpiresAt: now.Add(time.Hour), FirstSeen: firstSeen, LastSeen: firstSeen, Sightings: 5},
+		{Name: "expired.example.com", Src: "tester", SavedAt: firstSeen, ExpiresAt: now.Add(-time.Hour), FirstSeen: firstSeen, LastSeen: firstSeen, Sightings: 5},
+	}
+
+	require.NoError(t, repo.Put([]*BadEntity{
+		{Name: "alive.example.com", Src: "tester", SavedAt: now, ExpiresAt: now.Add(2 * time.Hour)},
+		{Name: "expired.example.com", Src: "tester", SavedAt: now, ExpiresAt: now.Add(2 * time.Hour)},
+	}))
+
+	items := testWrittenItems(t, client)
+	require.Equal(t, 2, len(items))
+
+	t.Run("sighting of alive item is merged", func(tt *testing.T) {
+		item := items["alive.example.com"]
+		assert.Equal(tt, 6, item.Sightings)
+		assert.True(tt, item.FirstSeen.Equal(firstSeen))
+		assert.True(tt, item.LastSeen.After(firstSeen))
+	})
+
+	t.Run("history of expired item is reset", func(tt *testing.T) {
+		item := items["expired.example.com"]
+		assert.Equal(tt, 1, item.Sightings)
+		assert.True(tt, item.FirstSeen.After(firstSeen))
+		assert.True(tt, item.FirstSeen.Equal(item.LastSeen))
+	})
+}
+
+// indexDynamoClient returns items as result of Query and records the inputs.
+type indexDynamoClient struct {
+	dynamodbiface.DynamoDBAPI
+	items   []dynamoEntityItem
+	queries []*dynamodb.QueryInput
+}
+
+func (x *indexDynamoClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	x.queries = append(x.queries, input)
+
+	var output dynamodb.QueryOutput
+	for _, item := range x.items {
+		attrs, err := dynamo.MarshalItem(item)
+		if err != nil {
+			return nil, err
+		}
+		output.Items = append(output.Items, attrs)
+	}
+	output.Count = aws.Int64(int64(len(output.Items)))
+	output.ScannedCount = output.Count
+	return &output, nil
+}
+
+func TestDynamoIterateBySourceIndex(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	client := &indexDynamoClient{items: []dynamoEntityItem{
+		{Name: "blue.example.com", Src: "alpha", Kind: KindDomain, SavedAt: base, Sightings: 1},
+		{Name: "192.0.2.1", Src: "alpha", Kind: KindIPv4, SavedAt: base.Add(time.Hour), Sightings: 1},
+		{Name: "expired.example.com", Src: "alpha", Kind: KindDomain, SavedAt: base, ExpiresAt: time.Now().Add(-time.Minute)},
+	}}
+	repo := &dynamoRepository{
+		table:       dynamo.NewFromIface(client).Table("test-table"),
+		client:      client,
+		sourceIndex: DynamoSourceIndex,
+	}
+
+	stats, err := repo.Count(context.Background(), EntityFilter{Src: "alpha"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Total)
+	assert.Equal(t, map[EntityKind]int{KindDomain: 1, KindIPv4: 1}, stats.Kinds)
+
+	require.Equal(t, 1, len(client.queries))
+	assert.Equal(t, DynamoSourceIndex, aws.StringValue(client.queries[0].IndexName))
+
+	// SavedAt range is checked by client side.
+	var names []string
+	for q := range repo.Iterate(context.Background(), EntityFilter{Src: "alpha", SavedAfter: base.Add(time.Minute)}) {
+		require.NoError(t, q.Error)
+		for _, e := range q.Entities {
+			names = append(names, e.Name)
+		}
+	}
+	assert.Equal(t, []string{"192.0.2.1"}, names)
+}
+
+func TestDynamoGetNetworksNotSupported(t *testing.T) {
+	repo := &dynamoRepository{}
+	_, err := repo.GetNetworks(net.ParseIP("192.0.2.1"))
+	assert.Equal(t, ErrNotSupported, errors.Cause(err))
+}
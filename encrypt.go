@@ -0,0 +1,445 @@
+package badman
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// EncryptionAESGCM is DumpFormat.Encryption of EncryptedSerializer.
+	EncryptionAESGCM = "aes-256-gcm"
+
+	// EncryptionKeySize is size of key for EncryptedSerializer and static KeyProvider.
+	EncryptionKeySize = 32
+
+	// defaultEncryptionChunkSize is size of plaintext that is sealed at once.
+	defaultEncryptionChunkSize = 64 * 1024
+	// encryptionVersion is version of encrypted stream format.
+	encryptionVersion = 1
+	// maxEncryptionChunkSize limits chunk size in encrypted stream not to allocate huge memory by broken data.
+	maxEncryptionChunkSize = 16 * 1024 * 1024
+	// maxWrappedKeySize limits size of encrypted data key in encrypted stream.
+	maxWrappedKeySize = 64 * 1024
+
+	encryptionNoncePrefixSize = 7
+	// encryptedDataKeyContext is additional data to wrap a data key by static KeyProvider.
+	encryptedDataKeyContext = "badman-data-key-v1"
+)
+
+// encryptionMagic is head of encrypted stream by EncryptedSerializer.
+var encryptionMagic = []byte("BMENC")
+
+// KeyProvider provides data key of EncryptedSerializer by envelope encryption. A new data key is generated for each Serialize and encrypted form of the key is stored in serialized data. It can be implemented with KMS, e.g. GenerateDataKey and Decrypt of AWS KMS.
+type KeyProvider interface {
+	// GenerateKey returns a new data key (EncryptionKeySize bytes) and encrypted form of the key.
+	GenerateKey() (key, encrypted []byte, err error)
+	// DecryptKey returns data key of encrypted form that is generated by GenerateKey.
+	DecryptKey(encrypted []byte) ([]byte, error)
+}
+
+// staticKeyProvider generates a random data key and wraps it by master key with AES-GCM.
+type staticKeyProvider struct {
+	aead cipher.AEAD
+}
+
+// NewStaticKeyProvider returns KeyProvider that wraps data keys by master key. Size of master key must be EncryptionKeySize.
+func NewStaticKeyProvider(masterKey []byte) (KeyProvider, error) {
+	if len(masterKey) != EncryptionKeySize {
+		return nil, errors.Errorf("Invalid encryption key size: %d bytes, %d bytes is required", len(masterKey), EncryptionKeySize)
+	}
+	aead, err := newAESGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &staticKeyProvider{aead: aead}, nil
+}
+
+// NewFileKeyProvider returns static KeyProvider with master key in file of path. The file has raw key (EncryptionKeySize bytes), or hex or base64 encoded key.
+func NewFileKeyProvider(path string) (KeyProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read encryption key file: %s", path)
+	}
+	key, err := parseEncryptionKey(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse encryption key file: %s", path)
+	}
+	return NewStaticKeyProvider(key)
+}
+
+// NewEnvKeyProvider returns static KeyProvider with master key in environment variable of name. The variable has hex or base64 encoded key.
+func NewEnvKeyProvider(name string) (KeyProvider, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, errors.Errorf("Environment variable of encryption key is not set: %s", name)
+	}
+	key, err := parseEncryptionKey([]byte(value))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse encryption key in environment variable: %s", name)
+	}
+	return NewStaticKeyProvider(key)
+}
+
+// parseEncryptionKey decodes raw, hex or base64 encoded key.
+func parseEncryptionKey(data []byte) ([]byte, error) {
+	if len(data) == EncryptionKeySize {
+		return data, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == EncryptionKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == EncryptionKeySize {
+		return key, nil
+	}
+	return nil, errors.Errorf("Encryption key must be %d bytes of raw, hex or base64 data", EncryptionKeySize)
+}
+
+func (x *staticKeyProvider) GenerateKey() ([]byte, []byte, error) {
+	key := make([]byte, EncryptionKeySize)
+	nonce := make([]byte, x.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, errors.Wrap(err, "Fail to generate data key")
+	}
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, errors.Wrap(err, "Fail to generate nonce of data key")
+	}
+
+	encrypted := x.aead.Seal(nonce, nonce, key, []byte(encryptedDataKeyContext))
+	return key, encrypted, nil
+}
+
+func (x *staticKeyProvider) DecryptKey(encrypted []byte) ([]byte, error) {
+	size := x.aead.NonceSize()
+	if len(encrypted) < size {
+		return nil, errors.New("Fail to decrypt data key, too short")
+	}
+	key, err := x.aead.Open(nil, encrypted[:size], encrypted[size:], []byte(encryptedDataKeyContext))
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to decrypt data key, encryption key may be wrong")
+	}
+	return key, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to create AES cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to create AES-GCM")
+	}
+	return aead, nil
+}
+
+// EncryptedSerializer is Serializer wrapper that encrypts output of another Serializer with AES-256-GCM. Data is encrypted by chunks, then Serialize and Deserialize never have whole data in memory. Each chunk is authenticated and end of the stream is also authenticated to detect truncation.
+type EncryptedSerializer struct {
+	ser       Serializer
+	provider  KeyProvider
+	chunkSize int
+}
+
+// NewEncryptedSerializer is constructor of EncryptedSerializer that encrypts output of ser with data keys by provider.
+func NewEncryptedSerializer(ser Serializer, provider KeyProvider) *EncryptedSerializer {
+	return &EncryptedSerializer{
+		ser:       ser,
+		provider:  provider,
+		chunkSize: defaultEncryptionChunkSize,
+	}
+}
+
+// Format of EncryptedSerializer returns DumpFormat of wrapped Serializer with Encryption. Encoding and Compression are empty if wrapped Serializer does not implement FormatSerializer.
+func (x *EncryptedSerializer) Format() DumpFormat {
+	var format DumpFormat
+	if ser, ok := x.ser.(FormatSerializer); ok {
+		format = ser.Format()
+	}
+	format.Encryption = EncryptionAESGCM
+	return format
+}
+
+// Serialize of EncryptedSerializer encrypts output of wrapped Serializer.
+func (x *EncryptedSerializer) Serialize(ch chan *EntityQueue, w io.Writer) error {
+	key, encrypted, err := x.provider.GenerateKey()
+	if err != nil {
+		drainEntityQueue(ch)
+		return errors.Wrap(err, "Fail to generate data key for encryption")
+	}
+
+	ew, err := newEncryptWriter(w, key, encrypted, x.chunkSize)
+	if err != nil {
+		drainEntityQueue(ch)
+		return err
+	}
+	if err := x.ser.Serialize(ch, ew); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// Deserialize of EncryptedSerializer decrypts data in r and passes it to wrapped Serializer.
+func (x *EncryptedSerializer) Deserialize(r io.Reader) chan *EntityQueue {
+	ch := make(chan *EntityQueue, jsonSerializerBufSize)
+
+	go func() {
+		defer close(ch)
+		dr, err := newDecryptReader(r, x.provider)
+		if err != nil {
+			ch <- &EntityQueue{Error: err}
+			return
+		}
+
+		for q := range x.ser.Deserialize(dr) {
+			ch <- q
+		}
+
+		// Wrapped Serializer may stop reading before the end or ignore error of reader, then make sure that whole stream is authenticated.
+		if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+			ch <- &EntityQueue{Error: err}
+		}
+	}()
+
+	return ch
+}
+
+// encryptionHeader is head of encrypted stream: encryptionMagic, version (uint8), chunk size (uint32), nonce prefix, length of encrypted data key (uint16) and encrypted data key. Whole header is additional data of all chunks.
+func encryptionHeader(chunkSize int, noncePrefix, encryptedKey []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.Write(encryptionMagic); err != nil {
+		return nil, err
+	}
+	if err := buf.WriteByte(encryptionVersion); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, uint32(chunkSize)); err != nil {
+		return nil, err
+	}
+	if _, err := buf.Write(noncePrefix); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, uint16(len(encryptedKey))); err != nil {
+		return nil, err
+	}
+	if _, err := buf.Write(encryptedKey); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// chunkNonce returns nonce of a chunk: nonce prefix, counter (uint32) and flag of the last chunk.
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, encryptionNoncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = append(nonce, byte(counter>>24), byte(counter>>16), byte(counter>>8), byte(counter))
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// encryptWriter seals data written into it by chunks and writes length (uint32) and ciphertext of each chunk into w. Close must be called to write the last chunk.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	ad      []byte
+	buf     []byte
+	counter uint32
+}
+
+func newEncryptWriter(w io.Writer, key, encryptedKey []byte, chunkSize int) (*encryptWriter, error) {
+	if len(encryptedKey) > maxWrappedKeySize {
+		return nil, errors.Errorf("Encrypted data key is too large: %d bytes", len(encryptedKey))
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, encryptionNoncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, errors.Wrap(err, "Fail to generate nonce for encryption")
+	}
+
+	header, err := encryptionHeader(chunkSize, prefix, encryptedKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to build encryption header")
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, errors.Wrap(err, "Fail to write encryption header")
+	}
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		ad:     header,
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (x *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := cap(x.buf) - len(x.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		x.buf = append(x.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		// Keep a full chunk until next Write because the last chunk must be sealed with the flag.
+		if len(x.buf) == cap(x.buf) && len(p) > 0 {
+			if err := x.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close seals buffered data as the last chunk. It does not close underlying writer.
+func (x *encryptWriter) Close() error {
+	return x.seal(true)
+}
+
+func (x *encryptWriter) seal(last bool) error {
+	if x.counter == ^uint32(0) {
+		return errors.New("Fail to encrypt, too many chunks")
+	}
+
+	sealed := x.aead.Seal(nil, chunkNonce(x.prefix, x.counter, last), x.buf, x.ad)
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := x.w.Write(length[:]); err != nil {
+		return errors.Wrap(err, "Fail to write encrypted chunk")
+	}
+	if _, err := x.w.Write(sealed); err != nil {
+		return errors.Wrap(err, "Fail to write encrypted chunk")
+	}
+
+	x.counter++
+	x.buf = x.buf[:0]
+	return nil
+}
+
+// decryptReader reads chunks written by encryptWriter and returns decrypted data. io.EOF is returned only after the last chunk is authenticated.
+type decryptReader struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	prefix    []byte
+	ad        []byte
+	chunkSize int
+	buf       []byte
+	counter   uint32
+	done      bool
+}
+
+func newDecryptReader(r io.Reader, provider KeyProvider) (*decryptReader, error) {
+	fixed := make([]byte, len(encryptionMagic)+1+4+encryptionNoncePrefixSize+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, errors.Wrap(err, "Fail to read encryption header")
+	}
+	if !bytes.Equal(fixed[:len(encryptionMagic)], encryptionMagic) {
+		return nil, errors.New("Fail to decrypt, data is not encrypted by EncryptedSerializer")
+	}
+
+	p := fixed[len(encryptionMagic):]
+	if p[0] != encryptionVersion {
+		return nil, errors.Errorf("Fail to decrypt, unsupported version: %d", p[0])
+	}
+	chunkSize := int(binary.BigEndian.Uint32(p[1:5]))
+	if chunkSize <= 0 || chunkSize > maxEncryptionChunkSize {
+		return nil, errors.Errorf("Fail to decrypt, invalid chunk size: %d", chunkSize)
+	}
+	prefix := append([]byte{}, p[5:5+encryptionNoncePrefixSize]...)
+	keyLen := int(binary.BigEndian.Uint16(p[5+encryptionNoncePrefixSize:]))
+
+	encryptedKey := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, encryptedKey); err != nil {
+		return nil, errors.Wrap(err, "Fail to read encrypted data key")
+	}
+	key, err := provider.DecryptKey(encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:         r,
+		aead:      aead,
+		prefix:    prefix,
+		ad:        append(fixed, encryptedKey...),
+		chunkSize: chunkSize,
+	}, nil
+}
+
+func (x *decryptReader) Read(p []byte) (int, error) {
+	for len(x.buf) == 0 {
+		if x.done {
+			return 0, io.EOF
+		}
+		if err := x.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, x.buf)
+	x.buf = x.buf[n:]
+	return n, nil
+}
+
+// open reads and decrypts next chunk into buf.
+func (x *decryptReader) open() error {
+	var length [4]byte
+	if _, err := io.ReadFull(x.r, length[:]); err != nil {
+		if err == io.EOF {
+			return errors.New("Fail to decrypt, encrypted data is truncated")
+		}
+		return errors.Wrap(err, "Fail to read encrypted chunk")
+	}
+
+	size := int(binary.BigEndian.Uint32(length[:]))
+	if size > x.chunkSize+x.aead.Overhead() {
+		return errors.Errorf("Fail to decrypt, too large chunk: %d bytes", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(x.r, sealed); err != nil {
+		return errors.Wrap(err, "Fail to read encrypted chunk")
+	}
+
+	// Try as a middle chunk at first, and then as the last chunk.
+	plain, err := x.aead.Open(nil, chunkNonce(x.prefix, x.counter, false), sealed, x.ad)
+	if err != nil {
+		if plain, err = x.aead.Open(nil, chunkNonce(x.prefix, x.counter, true), sealed, x.ad); err != nil {
+			return errors.Wrap(err, "Fail to decrypt, encrypted data is broken or tampered")
+		}
+		x.done = true
+
+		var trailing [1]byte
+		if n, _ := io.ReadFull(x.r, trailing[:]); n > 0 {
+			return errors.New("Fail to decrypt, unexpected data after the last chunk")
+		}
+	}
+
+	x.counter++
+	x.buf = plain
+	return nil
+}
@@ -0,0 +1,178 @@
+package badman_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-mizutani/badman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func genEncryptionKey(t *testing.T) []byte {
+	key := make([]byte, badman.EncryptionKeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func newTestEncryptedSerializer(t *testing.T, ser badman.Serializer, key []byte) *badman.EncryptedSerializer {
+	provider, err := badman.NewStaticKeyProvider(key)
+	require.NoError(t, err)
+	return badman.NewEncryptedSerializer(ser, provider)
+}
+
+func TestEncryptedSerializer(t *testing.T) {
+	key := genEncryptionKey(t)
+	serializerCommonTest(t, newTestEncryptedSerializer(t, badman.NewJSONSerializer(), key))
+	serializerCommonTest(t, newTestEncryptedSerializer(t, badman.NewGzipMsgpackSerializer(), key))
+
+	ser := newTestEncryptedSerializer(t, badman.NewJSONSerializer(), key)
+	badman.SetEncryptionChunkSize(ser, 16)
+	serializerCommonTest(t, ser)
+}
+
+// encryptedDump returns output of Dump with EncryptedSerializer of small chunks.
+func encryptedDump(t *testing.T, ser badman.Serializer, key []byte, n int) []byte {
+	enc := newTestEncryptedSerializer(t, ser, key)
+	badman.SetEncryptionChunkSize(enc, 64)
+
+	man := newDumpTestBadMan(t, n)
+	man.ReplaceSerializer(enc)
+	buf := &bytes.Buffer{}
+	require.NoError(t, man.Dump(buf))
+	return buf.Bytes()
+}
+
+func TestEncryptedDump(t *testing.T) {
+	key := genEncryptionKey(t)
+	data := encryptedDump(t, badman.NewJSONSerializer(), key, 20)
+
+	assert.False(t, bytes.Contains(data, []byte("blue1.example.com")))
+	header, err := badman.ReadDumpHeader(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, badman.EncryptionAESGCM, header.Encryption)
+	assert.Equal(t, badman.EncodingJSON, header.Encoding)
+	assert.Equal(t, 20, header.Entities)
+
+	t.Run("load", func(tt *testing.T) {
+		man := badman.New()
+		man.ReplaceSerializer(newTestEncryptedSerializer(tt, badman.NewJSONSerializer(), key))
+		require.NoError(tt, man.Load(bytes.NewReader(data)))
+		assert.Equal(tt, 20, countAll(tt, man))
+	})
+
+	t.Run("without EncryptedSerializer", func(tt *testing.T) {
+		assert.Error(tt, badman.New().Load(bytes.NewReader(data)))
+	})
+
+	t.Run("wrong key", func(tt *testing.T) {
+		man := badman.New()
+		man.ReplaceSerializer(newTestEncryptedSerializer(tt, badman.NewJSONSerializer(), genEncryptionKey(tt)))
+		assert.Error(tt, man.Load(bytes.NewReader(data)))
+	})
+}
+
+func TestEncryptedSerializerTampered(t *testing.T) {
+	key := genEncryptionKey(t)
+	ser := newTestEncryptedSerializer(t, badman.NewJSONSerializer(), key)
+	badman.SetEncryptionChunkSize(ser, 64)
+
+	ch := make(chan *badman.EntityQueue, 1)
+	ch <- &badman.EntityQueue{Entities: []*badman.BadEntity{
+		{Name: "blue.example.com", Src: "tester"},
+		{Name: "orange.example.com", Src: "tester"},
+		{Name: "red.example.com", Src: "tester"},
+	}}
+	close(ch)
+	buf := &bytes.Buffer{}
+	require.NoError(t, ser.Serialize(ch, buf))
+	data := buf.Bytes()
+
+	deserialize := func(data []byte) error {
+		for q := range ser.Deserialize(bytes.NewReader(data)) {
+			if q.Error != nil {
+				return q.Error
+			}
+		}
+		return nil
+	}
+
+	require.NoError(t, deserialize(data))
+
+	t.Run("flipped byte", func(tt *testing.T) {
+		tampered := append([]byte{}, data...)
+		tampered[len(tampered)-20] ^= 0xff
+		assert.Error(tt, deserialize(tampered))
+	})
+
+	t.Run("truncated", func(tt *testing.T) {
+		// The last chunk is lost or broken in all cases.
+		for _, size := range []int{len(data) - 1, len(data) - 20, len(data) / 2} {
+			assert.Error(tt, deserialize(data[:size]))
+		}
+	})
+
+	t.Run("trailing data", func(tt *testing.T) {
+		assert.Error(tt, deserialize(append(append([]byte{}, data...), 0)))
+	})
+
+	t.Run("not encrypted", func(tt *testing.T) {
+		assert.Error(tt, deserialize([]byte(`{"name":"blue.example.com"}`)))
+	})
+}
+
+func TestKeyProviders(t *testing.T) {
+	key := genEncryptionKey(t)
+	data := encryptedDump(t, badman.NewMsgpackSerializer(), key, 3)
+
+	load := func(tt *testing.T, provider badman.KeyProvider) {
+		man := badman.New()
+		man.ReplaceSerializer(badman.NewEncryptedSerializer(badman.NewMsgpackSerializer(), provider))
+		require.NoError(tt, man.Load(bytes.NewReader(data)))
+		assert.Equal(tt, 3, countAll(tt, man))
+	}
+
+	dir, err := ioutil.TempDir("", "badman")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("raw file", func(tt *testing.T) {
+		path := filepath.Join(dir, "raw.key")
+		require.NoError(tt, ioutil.WriteFile(path, key, 0600))
+		provider, err := badman.NewFileKeyProvider(path)
+		require.NoError(tt, err)
+		load(tt, provider)
+	})
+
+	t.Run("hex file", func(tt *testing.T) {
+		path := filepath.Join(dir, "hex.key")
+		require.NoError(tt, ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600))
+		provider, err := badman.NewFileKeyProvider(path)
+		require.NoError(tt, err)
+		load(tt, provider)
+	})
+
+	t.Run("base64 env", func(tt *testing.T) {
+		os.Setenv("BADMAN_TEST_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+		defer os.Unsetenv("BADMAN_TEST_ENCRYPTION_KEY")
+		provider, err := badman.NewEnvKeyProvider("BADMAN_TEST_ENCRYPTION_KEY")
+		require.NoError(tt, err)
+		load(tt, provider)
+	})
+
+	t.Run("invalid", func(tt *testing.T) {
+		_, err := badman.NewStaticKeyProvider([]byte("short"))
+		assert.Error(tt, err)
+		_, err = badman.NewEnvKeyProvider("BADMAN_TEST_NOT_EXISTING_KEY")
+		assert.Error(tt, err)
+		_, err = badman.NewFileKeyProvider(filepath.Join(dir, "not-existing.key"))
+		assert.Error(tt, err)
+	})
+}
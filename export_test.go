@@ -0,0 +1,13 @@
+package badman
+
+import "time"
+
+// EvictInMemoryRepository runs eviction of inMemoryRepository immediately. Use the function in only test case.
+func EvictInMemoryRepository(repo Repository, now time.Time) {
+	repo.(*inMemoryRepository).evict(now)
+}
+
+// SetEncryptionChunkSize changes chunk size of EncryptedSerializer to test a stream of multiple chunks. Use the function in only test case.
+func SetEncryptionChunkSize(ser *EncryptedSerializer, size int) {
+	ser.chunkSize = size
+}
@@ -3,12 +3,18 @@ module github.com/m-mizutani/badman
 go 1.13
 
 require (
+	github.com/alicebob/miniredis/v2 v2.11.4
 	github.com/aws/aws-sdk-go v1.26.8
+	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/google/uuid v1.1.1
 	github.com/guregu/dynamo v1.5.0
+	github.com/lib/pq v1.3.0
 	github.com/pkg/errors v0.8.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0
 	github.com/urfave/cli/v2 v2.1.1
 	github.com/vmihailenco/msgpack/v4 v4.3.1
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20191206172530-e9b2fee46413
+	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
 )
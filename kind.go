@@ -0,0 +1,75 @@
+package badman
+
+import (
+	"net"
+	"strings"
+)
+
+// EntityKind is type of BadEntity.
+type EntityKind string
+
+const (
+	// KindIPv4 is IPv4 address, e.g. "192.0.2.1"
+	KindIPv4 EntityKind = "ipv4"
+	// KindIPv6 is IPv6 address, e.g. "2001:db8::1"
+	KindIPv6 EntityKind = "ipv6"
+	// KindCIDR is network of CIDR or IP address range, e.g. "192.0.2.0/24" and "192.0.2.1-192.0.2.20"
+	KindCIDR EntityKind = "cidr"
+	// KindDomain is domain name, e.g. "example.com" and "*.example.com"
+	KindDomain EntityKind = "domain"
+	// KindURL is URL, e.g. "http://example.com/malware.exe"
+	KindURL EntityKind = "url"
+	// KindHash is hex encoded hash value of MD5, SHA1, SHA256 or SHA512.
+	KindHash EntityKind = "hash"
+)
+
+// hashLengths is length of hex encoded MD5, SHA1, SHA256 and SHA512.
+var hashLengths = map[int]bool{32: true, 40: true, 64: true, 128: true}
+
+// ClassifyName returns EntityKind of name. name should be normalized by NormalizeName.
+func ClassifyName(name string) EntityKind {
+	if addr := net.ParseIP(name); addr != nil {
+		if addr.To4() != nil {
+			return KindIPv4
+		}
+		return KindIPv6
+	}
+
+	switch {
+	case parseNetworks(name) != nil:
+		return KindCIDR
+	case strings.Contains(name, "://"):
+		return KindURL
+	case isHash(name):
+		return KindHash
+	default:
+		return KindDomain
+	}
+}
+
+func isHash(s string) bool {
+	if !hashLengths[len(s)] {
+		return false
+	}
+
+	for _, c := range s {
+		if !(('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchKind returns true if kinds is empty or kinds has kind.
+func matchKind(kind EntityKind, kinds []EntityKind) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package badman_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/badman"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyName(t *testing.T) {
+	testCases := map[string]badman.EntityKind{
+		"192.0.2.1":                                badman.KindIPv4,
+		"2001:db8::1":                              badman.KindIPv6,
+		"192.0.2.0/24":                             badman.KindCIDR,
+		"2001:db8::/32":                            badman.KindCIDR,
+		"192.0.2.1-192.0.2.20":                     badman.KindCIDR,
+		"blue.example.com":                         badman.KindDomain,
+		"*.example.com":                            badman.KindDomain,
+		"http://blue.example.com/x.exe":            badman.KindURL,
+		"d41d8cd98f00b204e9800998ecf8427e":         badman.KindHash,
+		"da39a3ee5e6b4b0d3255bfef95601890afd80709": badman.KindHash,
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855": badman.KindHash,
+	}
+
+	for name, expected := range testCases {
+		assert.Equal(t, expected, badman.ClassifyName(name), name)
+	}
+}
@@ -0,0 +1,217 @@
+package badman
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultCopyBatchSize is number of entities that are put into destination repository at once if CopyOptions.BatchSize is not set.
+const defaultCopyBatchSize = 1000
+
+// CopyOptions is options of CopyRepository, CopyTo and Migrate. Zero value is available.
+type CopyOptions struct {
+	// BatchSize is number of entities that are passed to Put of destination repository at once. Default is 1000.
+	BatchSize int
+
+	// Progress is called after every batch is put into destination repository with report of copied entities so far.
+	Progress func(report CopyReport)
+
+	// Checkpoint records entities that have been copied. Entities that are already recorded are skipped to resume an interrupted copy without doubling Sightings of them. Copy is not resumable if Checkpoint is nil.
+	Checkpoint CopyCheckpoint
+}
+
+// CopyReport is progress and result of CopyRepository.
+type CopyReport struct {
+	// Entities is number of entities that are put into destination repository.
+	Entities int
+	// Skipped is number of entities that are skipped because Checkpoint has them.
+	Skipped  int
+	Batches  int
+	Duration time.Duration
+}
+
+// CopyCheckpoint records entities copied by CopyRepository. An entity is identified by pair of Name and Src.
+type CopyCheckpoint interface {
+	// Done returns true if entity has been already copied.
+	Done(entity *BadEntity) bool
+	// Mark records entities that are put into destination repository successfully.
+	Mark(entities []*BadEntity) error
+}
+
+// CopyRepository reads all entities from src by Dump and puts them into dst by batch. Expired entities are not copied because Dump does not return them. src must support Dump. Entities are merged with ones that dst already has in the same manner with Put.
+func CopyRepository(ctx context.Context, dst, src Repository, opts CopyOptions) (*CopyReport, error) {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultCopyBatchSize
+	}
+
+	// Cancel Dump of src when copy fails in the middle.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := withContext(src).DumpContext(ctx)
+	if ch == nil {
+		return nil, fmt.Errorf("Source repository does not support Dump()")
+	}
+
+	to := withContext(dst)
+	report := &CopyReport{}
+	startedAt := time.Now()
+	batch := make([]*BadEntity, 0, batchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := to.PutContext(ctx, batch); err != nil {
+			return errors.Wrapf(err, "Fail to put %d entities into destination repository", len(batch))
+		}
+		if opts.Checkpoint != nil {
+			if err := opts.Checkpoint.Mark(batch); err != nil {
+				return errors.Wrap(err, "Fail to record checkpoint")
+			}
+		}
+
+		report.Entities += len(batch)
+		report.Batches++
+		report.Duration = time.Since(startedAt)
+		if opts.Progress != nil {
+			opts.Progress(*report)
+		}
+		// Do not reuse backing array because dst may keep the slice.
+		batch = make([]*BadEntity, 0, batchSize)
+		return nil
+	}
+
+	for q := range ch {
+		if q.Error != nil {
+			return report, errors.Wrap(q.Error, "Fail to dump source repository")
+		}
+
+		for _, entity := range q.Entities {
+			if opts.Checkpoint != nil && opts.Checkpoint.Done(entity) {
+				report.Skipped++
+				continue
+			}
+
+			batch = append(batch, entity)
+			if len(batch) >= batchSize {
+				if err := flush(); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+
+	// Dump completes normally when the channel is closed by cancellation.
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	if err := flush(); err != nil {
+		return report, err
+	}
+
+	report.Duration = time.Since(startedAt)
+	return report, nil
+}
+
+// CopyTo copies all entities of current repository into dst. Current repository is not changed.
+func (x *BadMan) CopyTo(dst Repository, opts CopyOptions) (*CopyReport, error) {
+	return x.CopyToContext(context.Background(), dst, opts)
+}
+
+// CopyToContext is same with CopyTo, but it can be cancelled by ctx.
+func (x *BadMan) CopyToContext(ctx context.Context, dst Repository, opts CopyOptions) (*CopyReport, error) {
+	return CopyRepository(ctx, dst, x.repository(), opts)
+}
+
+// Migrate copies all entities of current repository into dst, and then replaces current repository with dst. Current repository is kept if copy fails. Entities that are inserted into current repository during copy may not be copied.
+func (x *BadMan) Migrate(dst Repository, opts CopyOptions) (*CopyReport, error) {
+	return x.MigrateContext(context.Background(), dst, opts)
+}
+
+// MigrateContext is same with Migrate, but it can be cancelled by ctx.
+func (x *BadMan) MigrateContext(ctx context.Context, dst Repository, opts CopyOptions) (*CopyReport, error) {
+	report, err := x.CopyToContext(ctx, dst, opts)
+	if err != nil {
+		return report, err
+	}
+
+	x.ReplaceRepository(dst)
+	return report, nil
+}
+
+// fileCheckpoint is CopyCheckpoint that appends keys of copied entities to a file line by line. It's safe for concurrent use.
+type fileCheckpoint struct {
+	lock sync.Mutex
+	fd   *os.File
+	done map[string]struct{}
+}
+
+// NewFileCheckpoint is constructor of CopyCheckpoint that is persisted in a file at path. Entities recorded in the file by previous copy are loaded if the file exists. Close should be called when the copy completed.
+func NewFileCheckpoint(path string) (CopyCheckpoint, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to open checkpoint file: %s", path)
+	}
+
+	done := make(map[string]struct{})
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			done[line] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fd.Close()
+		return nil, errors.Wrapf(err, "Fail to read checkpoint file: %s", path)
+	}
+
+	return &fileCheckpoint{fd: fd, done: done}, nil
+}
+
+// checkpointKey returns key of entity in checkpoint file. Names never contain tab and newline, and they are replaced in src.
+func checkpointKey(entity *BadEntity) string {
+	src := strings.NewReplacer("\t", " ", "\n", " ").Replace(entity.Src)
+	return entity.Name + "\t" + src
+}
+
+func (x *fileCheckpoint) Done(entity *BadEntity) bool {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	_, ok := x.done[checkpointKey(entity)]
+	return ok
+}
+
+func (x *fileCheckpoint) Mark(entities []*BadEntity) error {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	var buf strings.Builder
+	for _, entity := range entities {
+		key := checkpointKey(entity)
+		x.done[key] = struct{}{}
+		buf.WriteString(key)
+		buf.WriteByte('\n')
+	}
+
+	if _, err := x.fd.WriteString(buf.String()); err != nil {
+		return errors.Wrapf(err, "Fail to write checkpoint file: %s", x.fd.Name())
+	}
+	return nil
+}
+
+// Close closes the checkpoint file. The file is kept to resume the copy, so remove it after a successful copy if it's not needed.
+func (x *fileCheckpoint) Close() error {
+	if err := x.fd.Close(); err != nil {
+		return errors.Wrapf(err, "Fail to close checkpoint file: %s", x.fd.Name())
+	}
+	return nil
+}
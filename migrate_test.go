@@ -0,0 +1,153 @@
+package badman_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/badman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func putTestEntities(t *testing.T, repo badman.Repository, n int) {
+	entities := make([]*badman.BadEntity, n)
+	for i := range entities {
+		entities[i] = &badman.BadEntity{
+			Name:    fmt.Sprintf("%d.example.com", i),
+			SavedAt: time.Now(),
+			Src:     "tester",
+		}
+	}
+	require.NoError(t, repo.Put(entities))
+}
+
+func countEntities(t *testing.T, repo badman.Repository) int {
+	var n int
+	for q := range repo.Dump() {
+		require.NoError(t, q.Error)
+		n += len(q.Entities)
+	}
+	return n
+}
+
+// brokenRepository fails Put after limit entities are stored.
+type brokenRepository struct {
+	badman.Repository
+	limit int
+}
+
+func (x *brokenRepository) Put(entities []*badman.BadEntity) error {
+	if x.limit < len(entities) {
+		return errors.New("disk full")
+	}
+	x.limit -= len(entities)
+	return x.Repository.Put(entities)
+}
+
+func TestCopyRepository(t *testing.T) {
+	src := badman.NewInMemoryRepository()
+	putTestEntities(t, src, 250)
+	dst := badman.NewInMemoryRepository()
+
+	var progress []int
+	report, err := badman.CopyRepository(context.Background(), dst, src, badman.CopyOptions{
+		BatchSize: 100,
+		Progress: func(r badman.CopyReport) {
+			progress = append(progress, r.Entities)
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 250, report.Entities)
+	assert.Equal(t, 3, report.Batches)
+	assert.Equal(t, []int{100, 200, 250}, progress)
+	assert.Equal(t, 250, countEntities(t, dst))
+
+	entities, err := dst.Get("7.example.com")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entities))
+	assert.Equal(t, "tester", entities[0].Src)
+	assert.Equal(t, 1, entities[0].Sightings)
+}
+
+func TestCopyRepositoryResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badman")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+
+	src := badman.NewInMemoryRepository()
+	putTestEntities(t, src, 250)
+	dst := &brokenRepository{Repository: badman.NewInMemoryRepository(), limit: 200}
+
+	checkpoint, err := badman.NewFileCheckpoint(path)
+	require.NoError(t, err)
+	report, err := badman.CopyRepository(context.Background(), dst, src, badman.CopyOptions{
+		BatchSize:  100,
+		Checkpoint: checkpoint,
+	})
+	require.Error(t, err)
+	assert.Equal(t, 200, report.Entities)
+	require.NoError(t, checkpoint.(io.Closer).Close())
+
+	// Resume with checkpoint that is reloaded from the file.
+	dst.limit = 1000
+	checkpoint, err = badman.NewFileCheckpoint(path)
+	require.NoError(t, err)
+	defer checkpoint.(io.Closer).Close()
+	report, err = badman.CopyRepository(context.Background(), dst, src, badman.CopyOptions{
+		BatchSize:  100,
+		Checkpoint: checkpoint,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 50, report.Entities)
+	assert.Equal(t, 200, report.Skipped)
+	assert.Equal(t, 250, countEntities(t, dst))
+
+	// Sightings are not doubled by resumed copy.
+	for q := range dst.Dump() {
+		for _, e := range q.Entities {
+			assert.Equal(t, 1, e.Sightings)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	man := badman.New()
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "blue.example.com", SavedAt: time.Now(), Src: "tester"}))
+
+	dst := badman.NewInMemoryRepository()
+	report, err := man.Migrate(dst, badman.CopyOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Entities)
+
+	// Inserted entity goes to new repository.
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "orange.example.com", SavedAt: time.Now(), Src: "tester"}))
+	entities, err := dst.Get("orange.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+
+	entities, err = man.Lookup("blue.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entities))
+}
+
+func TestMigrateFailure(t *testing.T) {
+	man := badman.New()
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "blue.example.com", SavedAt: time.Now(), Src: "tester"}))
+
+	dst := &brokenRepository{Repository: badman.NewInMemoryRepository()}
+	_, err := man.Migrate(dst, badman.CopyOptions{})
+	require.Error(t, err)
+
+	// Current repository is kept.
+	require.NoError(t, man.Insert(badman.BadEntity{Name: "orange.example.com", SavedAt: time.Now(), Src: "tester"}))
+	assert.Equal(t, 0, countEntities(t, dst))
+}
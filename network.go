@@ -0,0 +1,179 @@
+package badman
+
+import (
+	"math/big"
+	"net"
+	"strings"
+)
+
+// parseNetworks parses name as CIDR (e.g. "192.0.2.0/24") or IP address range
+// (e.g. "192.0.2.1-192.0.2.20") and returns networks that exactly cover it.
+// nil is returned if name is neither CIDR nor IP address range.
+func parseNetworks(name string) []*net.IPNet {
+	if strings.Contains(name, "/") {
+		_, ipnet, err := net.ParseCIDR(name)
+		if err != nil {
+			return nil
+		}
+		return []*net.IPNet{canonicalNetwork(ipnet)}
+	}
+
+	if pos := strings.Index(name, "-"); pos > 0 {
+		first, last := net.ParseIP(name[:pos]), net.ParseIP(name[pos+1:])
+		if first == nil || last == nil {
+			return nil
+		}
+		return rangeToNetworks(first, last)
+	}
+
+	return nil
+}
+
+// canonicalNetwork converts IPv4-mapped IPv6 network (e.g. "::ffff:192.0.2.0/120")
+// to IPv4 network (e.g. "192.0.2.0/24") so that it's indexed and matched as
+// same as IPv4 network. Other networks are returned as is.
+func canonicalNetwork(network *net.IPNet) *net.IPNet {
+	ones, bits := network.Mask.Size()
+	if ip4 := network.IP.To4(); ip4 != nil && bits == net.IPv6len*8 && ones >= 96 {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, net.IPv4len*8)}
+	}
+	return network
+}
+
+// rangeToNetworks splits IP address range from first to last (both inclusive)
+// into minimum set of networks. nil is returned if address families of first
+// and last are different or first is greater than last.
+func rangeToNetworks(first, last net.IP) []*net.IPNet {
+	if f4, l4 := first.To4(), last.To4(); f4 != nil && l4 != nil {
+		first, last = f4, l4
+	} else if f4 != nil || l4 != nil {
+		return nil
+	}
+
+	bits := len(first) * 8
+	cur := new(big.Int).SetBytes(first)
+	end := new(big.Int).SetBytes(last)
+	one := big.NewInt(1)
+
+	var networks []*net.IPNet
+	for cur.Cmp(end) <= 0 {
+		// Find the largest block that starts at cur and does not exceed end.
+		size := 0
+		for size < bits && cur.Bit(size) == 0 {
+			blockEnd := new(big.Int).Lsh(one, uint(size+1))
+			blockEnd.Add(blockEnd, cur).Sub(blockEnd, one)
+			if blockEnd.Cmp(end) > 0 {
+				break
+			}
+			size++
+		}
+
+		ip := make(net.IP, len(first))
+		raw := cur.Bytes()
+		copy(ip[len(ip)-len(raw):], raw)
+		networks = append(networks, &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(bits-size, bits),
+		})
+
+		cur.Add(cur, new(big.Int).Lsh(one, uint(size)))
+	}
+
+	return networks
+}
+
+// ipTrie is binary radix trie of networks to search all networks that
+// contain an IP address. IPv4 and IPv6 networks are stored in separated trees.
+type ipTrie struct {
+	v4, v6 *ipTrieNode
+}
+
+type ipTrieNode struct {
+	child [2]*ipTrieNode
+	names map[string]struct{}
+}
+
+func newIPTrie() *ipTrie {
+	return &ipTrie{
+		v4: &ipTrieNode{},
+		v6: &ipTrieNode{},
+	}
+}
+
+func (x *ipTrie) root(ip net.IP) (*ipTrieNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return x.v4, ip4
+	}
+	return x.v6, ip.To16()
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// insert adds name to the node of network.
+func (x *ipTrie) insert(network *net.IPNet, name string) {
+	network = canonicalNetwork(network)
+	node, ip := x.root(network.IP)
+	ones, _ := network.Mask.Size()
+
+	for i := 0; i < ones; i++ {
+		b := ipBit(ip, i)
+		if node.child[b] == nil {
+			node.child[b] = &ipTrieNode{}
+		}
+		node = node.child[b]
+	}
+
+	if node.names == nil {
+		node.names = make(map[string]struct{})
+	}
+	node.names[name] = struct{}{}
+}
+
+// remove deletes name from the node of network. Empty nodes are kept because
+// they are reused by next insert in most cases.
+func (x *ipTrie) remove(network *net.IPNet, name string) {
+	network = canonicalNetwork(network)
+	node, ip := x.root(network.IP)
+	ones, _ := network.Mask.Size()
+
+	for i := 0; i < ones && node != nil; i++ {
+		node = node.child[ipBit(ip, i)]
+	}
+
+	if node != nil {
+		delete(node.names, name)
+	}
+}
+
+// lookup returns names of all networks that contain addr. The names are
+// sorted by prefix length in descending order (longest prefix match first).
+func (x *ipTrie) lookup(addr net.IP) []string {
+	node, ip := x.root(addr)
+	if ip == nil {
+		return nil
+	}
+
+	var matched [][]string
+	for i := 0; node != nil; i++ {
+		if len(node.names) > 0 {
+			var names []string
+			for name := range node.names {
+				names = append(names, name)
+			}
+			matched = append(matched, names)
+		}
+
+		if i >= len(ip)*8 {
+			break
+		}
+		node = node.child[ipBit(ip, i)]
+	}
+
+	var names []string
+	for i := len(matched) - 1; i >= 0; i-- {
+		names = append(names, matched[i]...)
+	}
+	return names
+}
@@ -0,0 +1,65 @@
+package badman
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNetworks(t *testing.T) {
+	n1 := parseNetworks("192.0.2.0/24")
+	require.Equal(t, 1, len(n1))
+	assert.Equal(t, "192.0.2.0/24", n1[0].String())
+
+	n2 := parseNetworks("2001:db8::/32")
+	require.Equal(t, 1, len(n2))
+	assert.Equal(t, "2001:db8::/32", n2[0].String())
+
+	n3 := parseNetworks("192.0.2.1-192.0.2.5")
+	require.Equal(t, 3, len(n3))
+	assert.Equal(t, "192.0.2.1/32", n3[0].String())
+	assert.Equal(t, "192.0.2.2/31", n3[1].String())
+	assert.Equal(t, "192.0.2.4/31", n3[2].String())
+
+	n4 := parseNetworks("10.0.0.0-10.255.255.255")
+	require.Equal(t, 1, len(n4))
+	assert.Equal(t, "10.0.0.0/8", n4[0].String())
+
+	n5 := parseNetworks("::ffff:192.0.2.0/120")
+	require.Equal(t, 1, len(n5))
+	assert.Equal(t, "192.0.2.0/24", n5[0].String())
+
+	assert.Nil(t, parseNetworks("192.0.2.1"))
+	assert.Nil(t, parseNetworks("blue.example.com"))
+	assert.Nil(t, parseNetworks("192.0.2.0/33"))
+	assert.Nil(t, parseNetworks("192.0.2.9-192.0.2.1"))
+	assert.Nil(t, parseNetworks("192.0.2.1-2001:db8::1"))
+}
+
+func TestIPTrie(t *testing.T) {
+	trie := newIPTrie()
+	for _, name := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "2001:db8::/32"} {
+		_, network, err := net.ParseCIDR(name)
+		require.NoError(t, err)
+		trie.insert(network, name)
+	}
+
+	assert.Equal(t, []string{"10.1.2.0/24", "10.1.0.0/16", "10.0.0.0/8"}, trie.lookup(net.ParseIP("10.1.2.3")))
+	assert.Equal(t, []string{"10.0.0.0/8"}, trie.lookup(net.ParseIP("10.2.0.1")))
+	assert.Equal(t, []string{"2001:db8::/32"}, trie.lookup(net.ParseIP("2001:db8::1")))
+	assert.Nil(t, trie.lookup(net.ParseIP("192.0.2.1")))
+
+	_, mapped, err := net.ParseCIDR("::ffff:192.0.2.0/120")
+	require.NoError(t, err)
+	trie.insert(mapped, "::ffff:192.0.2.0/120")
+	assert.Equal(t, []string{"::ffff:192.0.2.0/120"}, trie.lookup(net.ParseIP("192.0.2.1")))
+	trie.remove(mapped, "::ffff:192.0.2.0/120")
+	assert.Empty(t, trie.lookup(net.ParseIP("192.0.2.1")))
+
+	_, network, err := net.ParseCIDR("10.1.0.0/16")
+	require.NoError(t, err)
+	trie.remove(network, "10.1.0.0/16")
+	assert.Equal(t, []string{"10.1.2.0/24", "10.0.0.0/8"}, trie.lookup(net.ParseIP("10.1.2.3")))
+}
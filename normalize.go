@@ -0,0 +1,165 @@
+package badman
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/idna"
+)
+
+const (
+	maxDomainLength = 253
+	maxLabelLength  = 63
+)
+
+// idnaProfile converts IDN to punycode. StrictDomainName is disabled because
+// blacklists often have underscore in domain name and it's validated by
+// validateDomain instead.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.StrictDomainName(false),
+)
+
+// NormalizeName converts name of entity to canonical form that is used in repository. IP address is converted to shortest text form (e.g. "2001:DB8:0::1" -> "2001:db8::1"), CIDR is converted to network address (e.g. "192.0.2.1/24" -> "192.0.2.0/24") and domain name is lower-cased, trailing dot is removed and IDN is converted to punycode (e.g. "EXAMPLE.com." -> "example.com"). Host part of URL is normalized in same manner and hash value is lower-cased. Error is returned if name is not valid IP address, CIDR, IP address range, domain name, URL or hash value.
+func NormalizeName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("Empty name")
+	}
+
+	if addr := parseIPText(name); addr != nil {
+		return addr.String(), nil
+	}
+
+	if strings.Contains(name, "://") {
+		return normalizeURL(name)
+	}
+
+	if strings.Contains(name, "/") {
+		_, network, err := net.ParseCIDR(name)
+		if err != nil {
+			return "", errors.Wrapf(err, "Invalid CIDR: %q", name)
+		}
+		return network.String(), nil
+	}
+
+	if pos := strings.Index(name, "-"); pos > 0 {
+		first, last := parseIPText(name[:pos]), parseIPText(name[pos+1:])
+		if first != nil && last != nil {
+			if rangeToNetworks(first, last) == nil {
+				return "", errors.Errorf("Invalid IP address range: %q", name)
+			}
+			return first.String() + "-" + last.String(), nil
+		}
+	}
+
+	if isHash(name) {
+		return strings.ToLower(name), nil
+	}
+
+	return normalizeDomain(name)
+}
+
+// NormalizeEntity replaces Name of entity with normalized one by NormalizeName. Kind of entity is also set by ClassifyName if it's empty.
+func NormalizeEntity(entity *BadEntity) error {
+	name, err := NormalizeName(entity.Name)
+	if err != nil {
+		return err
+	}
+
+	entity.Name = name
+	if entity.Kind == "" {
+		entity.Kind = ClassifyName(name)
+	}
+	return nil
+}
+
+// parseIPText parses IP address that may be enclosed by square brackets, such as "[2001:db8::1]".
+func parseIPText(s string) net.IP {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	return net.ParseIP(s)
+}
+
+func normalizeURL(name string) (string, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid URL: %q", name)
+	}
+	if u.Scheme == "" || u.Hostname() == "" {
+		return "", errors.Errorf("URL has no scheme or host: %q", name)
+	}
+
+	host, err := NormalizeName(u.Hostname())
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid host in URL: %q", name)
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" {
+		host = host + ":" + port
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = host
+	return u.String(), nil
+}
+
+func normalizeDomain(name string) (string, error) {
+	domain := strings.TrimRight(name, ".")
+
+	wildcard := strings.HasPrefix(domain, wildcardPrefix)
+	if wildcard {
+		domain = domain[len(wildcardPrefix):]
+	}
+
+	domain, err := idnaProfile.ToASCII(domain)
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid domain name: %q", name)
+	}
+	domain = strings.ToLower(domain)
+
+	if err := validateDomain(domain); err != nil {
+		return "", errors.Wrapf(err, "Invalid domain name: %q", name)
+	}
+
+	if wildcard {
+		domain = wildcardPrefix + domain
+	}
+
+	return domain, nil
+}
+
+func validateDomain(domain string) error {
+	if domain == "" {
+		return errors.New("Empty domain name")
+	}
+	if len(domain) > maxDomainLength {
+		return errors.Errorf("Too long domain name (%d)", len(domain))
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" {
+			return errors.New("Empty label")
+		}
+		if len(label) > maxLabelLength {
+			return errors.Errorf("Too long label (%d): %s", len(label), label)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.Errorf("Label starts or ends with hyphen: %s", label)
+		}
+
+		for _, c := range label {
+			if !(('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_') {
+				return errors.Errorf("Invalid character %q in label: %s", c, label)
+			}
+		}
+	}
+
+	return nil
+}
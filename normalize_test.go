@@ -0,0 +1,53 @@
+package badman_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/badman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeName(t *testing.T) {
+	testCases := map[string]string{
+		"EVIL.com.":             "evil.com",
+		"  evil.com ":           "evil.com",
+		"*.Example.COM":         "*.example.com",
+		"_dmarc.example.com":    "_dmarc.example.com",
+		"bücher.example":        "xn--bcher-kva.example",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+		"192.0.2.1":             "192.0.2.1",
+		"2001:DB8:0:0::1":       "2001:db8::1",
+		"[2001:db8::1]":         "2001:db8::1",
+		"::ffff:192.0.2.1":      "192.0.2.1",
+		"192.0.2.17/24":         "192.0.2.0/24",
+		"2001:DB8::/32":         "2001:db8::/32",
+		"192.0.2.1-192.0.2.20":  "192.0.2.1-192.0.2.20",
+		"blue-orange.example":   "blue-orange.example",
+
+		"HTTP://Blue.Example.COM:8080/Malware.exe": "http://blue.example.com:8080/Malware.exe",
+		"http://[2001:DB8::1]/x":                   "http://[2001:db8::1]/x",
+		"D41D8CD98F00B204E9800998ECF8427E":         "d41d8cd98f00b204e9800998ecf8427e",
+	}
+
+	for input, expected := range testCases {
+		actual, err := badman.NormalizeName(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, expected, actual, input)
+	}
+
+	for _, input := range []string{
+		"",
+		"   ",
+		"evil..com",
+		"-evil.com",
+		"evil com",
+		"http:///no-host",
+		"http://evil..com/",
+		"192.0.2.0/33",
+		"192.0.2.20-192.0.2.1",
+	} {
+		_, err := badman.NormalizeName(input)
+		assert.Error(t, err, input)
+	}
+}
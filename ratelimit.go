@@ -0,0 +1,73 @@
+package badman
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// capacityLimiter limits average consumption of capacity units per second. Units are consumed after a request because consumed read capacity of DynamoDB is known only in the response, then a next request waits until the consumed units are paid back. It's safe for concurrent use.
+type capacityLimiter struct {
+	rate float64 // units per second
+
+	lock sync.Mutex
+	next time.Time
+	now  func() time.Time
+}
+
+// newCapacityLimiter returns capacityLimiter. nil is returned if rate is not positive, and methods of nil limiter do nothing.
+func newCapacityLimiter(rate float64) *capacityLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &capacityLimiter{rate: rate, now: time.Now}
+}
+
+// consume records units that have been consumed.
+func (x *capacityLimiter) consume(units float64) {
+	if x == nil || units <= 0 {
+		return
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	now := x.now()
+	if x.next.Before(now) {
+		x.next = now
+	}
+	x.next = x.next.Add(time.Duration(units / x.rate * float64(time.Second)))
+}
+
+// delay returns duration to wait before next request.
+func (x *capacityLimiter) delay() time.Duration {
+	if x == nil {
+		return 0
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	now := x.now()
+	if !x.next.After(now) {
+		return 0
+	}
+	return x.next.Sub(now)
+}
+
+// wait blocks until consumed units are paid back or ctx is done.
+func (x *capacityLimiter) wait(ctx context.Context) error {
+	d := x.delay()
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,49 @@
+package badman
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapacityLimiter(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := base
+	limiter := newCapacityLimiter(10)
+	limiter.now = func() time.Time { return now }
+
+	assert.Equal(t, time.Duration(0), limiter.delay())
+
+	// 5 units at 10 units/sec must wait 0.5 sec.
+	limiter.consume(5)
+	assert.Equal(t, 500*time.Millisecond, limiter.delay())
+	limiter.consume(5)
+	assert.Equal(t, time.Second, limiter.delay())
+
+	now = base.Add(time.Second)
+	assert.Equal(t, time.Duration(0), limiter.delay())
+
+	// Idle time is not saved up for burst.
+	now = base.Add(time.Minute)
+	limiter.consume(1)
+	assert.Equal(t, 100*time.Millisecond, limiter.delay())
+}
+
+func TestCapacityLimiterUnlimited(t *testing.T) {
+	limiter := newCapacityLimiter(0)
+	require.Nil(t, limiter)
+	limiter.consume(100)
+	assert.NoError(t, limiter.wait(context.Background()))
+}
+
+func TestCapacityLimiterWaitCancel(t *testing.T) {
+	limiter := newCapacityLimiter(1)
+	limiter.consume(60)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, limiter.wait(ctx))
+}
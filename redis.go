@@ -0,0 +1,461 @@
+package badman
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// RedisConfig is configuration of redisRepository.
+type RedisConfig struct {
+	// Addr is address of Redis server (e.g. "localhost:6379").
+	Addr     string
+	Password string
+	DB       int
+
+	// KeyPrefix is added to all keys to share a Redis server with other applications. Default is "badman:".
+	KeyPrefix string
+
+	// KeyTTL is expiry of a key of name and index sets of Src and networks. The expiry is extended by Put. Zero value means keys never expire.
+	KeyTTL time.Duration
+}
+
+const (
+	// redisDefaultKeyPrefix is default value of RedisConfig.KeyPrefix.
+	redisDefaultKeyPrefix = "badman:"
+	// redisScanCount is COUNT hint of SCAN and SSCAN.
+	redisScanCount = 1000
+)
+
+// redisRepository is repository by Redis. A hash per name has entities keyed by Src. Sets of names are used as index of Src and networks.
+type redisRepository struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedisRepository is constructor of redisRepository. It returns error if the Redis server is not available.
+func NewRedisRepository(config RedisConfig) (Repository, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     config.Addr,
+		Password: config.Password,
+		DB:       config.DB,
+	})
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, errors.Wrapf(err, "Fail to connect Redis: %s", config.Addr)
+	}
+
+	prefix := config.KeyPrefix
+	if prefix == "" {
+		prefix = redisDefaultKeyPrefix
+	}
+
+	return &redisRepository{
+		client: client,
+		prefix: prefix,
+		ttl:    config.KeyTTL,
+	}, nil
+}
+
+// Close closes connections to Redis server.
+func (x *redisRepository) Close() error {
+	if err := x.client.Close(); err != nil {
+		return errors.Wrap(err, "Fail to close Redis client")
+	}
+	return nil
+}
+
+func (x *redisRepository) entityKey(name string) string {
+	return x.prefix + "entity:" + name
+}
+
+func (x *redisRepository) srcKey(src string) string {
+	return x.prefix + "src:" + src
+}
+
+func (x *redisRepository) networkKey(network *net.IPNet) string {
+	return x.prefix + "net:" + network.String()
+}
+
+func (x *redisRepository) networkKeys(name string) []string {
+	var keys []string
+	for _, network := range parseNetworks(name) {
+		keys = append(keys, x.networkKey(network))
+	}
+	return keys
+}
+
+func decodeRedisEntity(raw string) (*BadEntity, error) {
+	var entity BadEntity
+	if err := msgpack.Unmarshal([]byte(raw), &entity); err != nil {
+		return nil, errors.Wrap(err, "Fail to decode entity")
+	}
+	return &entity, nil
+}
+
+func (x *redisRepository) Put(entities []*BadEntity) error {
+	return x.PutContext(context.Background(), entities)
+}
+
+// PutContext writes entities by 2 pipelines. The first one reads existing entities to merge sighting history and the second one writes merged entities. Sighting history may be lost when multiple writers put an entity of same name and Src at the same time.
+func (x *redisRepository) PutContext(ctx context.Context, entities []*BadEntity) error {
+	if len(entities) == 0 {
+		return nil
+	}
+	client := x.client.WithContext(ctx)
+
+	olds := make([]*redis.StringCmd, len(entities))
+	_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, e := range entities {
+			olds[i] = pipe.HGet(x.entityKey(e.Name), e.Src)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return errors.Wrap(err, "Fail to get existing entities from Redis")
+	}
+
+	now := time.Now()
+	indexKeys := map[string]struct{}{}
+	_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, e := range entities {
+			entity := sighted(*e, now)
+			raw, err := olds[i].Result()
+			if err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "Fail to get existing entity of %s from Redis", e.Name)
+			}
+			if err == nil {
+				old, err := decodeRedisEntity(raw)
+				if err != nil {
+					return errors.Wrapf(err, "Invalid entity of %s in Redis", e.Name)
+				}
+				if !old.Expired(now) {
+					entity = mergeSighting(*old, entity, isFreshSighting(e))
+				}
+			}
+
+			encoded, err := msgpack.Marshal(&entity)
+			if err != nil {
+				return errors.Wrapf(err, "Fail to encode entity: %v", entity)
+			}
+
+			key := x.entityKey(e.Name)
+			pipe.HSet(key, e.Src, encoded)
+			if x.ttl > 0 {
+				pipe.Expire(key, x.ttl)
+			}
+			pipe.SAdd(x.srcKey(e.Src), e.Name)
+			indexKeys[x.srcKey(e.Src)] = struct{}{}
+			for _, netKey := range x.networkKeys(e.Name) {
+				pipe.SAdd(netKey, e.Name)
+				indexKeys[netKey] = struct{}{}
+			}
+		}
+
+		// Index sets live as long as the latest entity key in them. Members of expired entity keys are removed by Prune.
+		if x.ttl > 0 {
+			for key := range indexKeys {
+				pipe.Expire(key, x.ttl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "Fail to put entities to Redis")
+	}
+
+	return nil
+}
+
+func (x *redisRepository) Get(name string) ([]BadEntity, error) {
+	return x.GetContext(context.Background(), name)
+}
+
+func (x *redisRepository) GetContext(ctx context.Context, name string) ([]BadEntity, error) {
+	values, err := x.client.WithContext(ctx).HGetAll(x.entityKey(name)).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get %s from Redis", name)
+	}
+
+	return toRedisEntities(name, values, time.Now())
+}
+
+// toRedisEntities decodes values of a hash of name and returns entities that are not expired at now.
+func toRedisEntities(name string, values map[string]string, now time.Time) ([]BadEntity, error) {
+	var entities []BadEntity
+	for _, raw := range values {
+		entity, err := decodeRedisEntity(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid entity of %s in Redis", name)
+		}
+		if !entity.Expired(now) {
+			entities = append(entities, *entity)
+		}
+	}
+	return entities, nil
+}
+
+func (x *redisRepository) GetNetworks(addr net.IP) ([]BadEntity, error) {
+	return x.GetNetworksContext(context.Background(), addr)
+}
+
+// GetNetworksContext reads sets of all networks that contain addr in one pipeline and then reads entities of matched names in another pipeline.
+func (x *redisRepository) GetNetworksContext(ctx context.Context, addr net.IP) ([]BadEntity, error) {
+	ip := addr.To4()
+	if ip == nil {
+		ip = addr.To16()
+	}
+	if ip == nil {
+		return nil, nil
+	}
+	client := x.client.WithContext(ctx)
+
+	// Longer prefix comes first.
+	bits := len(ip) * 8
+	members := make([]*redis.StringSliceCmd, 0, bits+1)
+	_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+		for ones := bits; ones >= 0; ones-- {
+			network := &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+			members = append(members, pipe.SMembers(x.networkKey(network)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get networks of %s from Redis", addr)
+	}
+
+	var names []string
+	seen := map[string]struct{}{}
+	for _, cmd := range members {
+		for _, name := range cmd.Val() {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	values := make([]*redis.StringStringMapCmd, len(names))
+	_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, name := range names {
+			values[i] = pipe.HGetAll(x.entityKey(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get entities of %s from Redis", addr)
+	}
+
+	now := time.Now()
+	var entities []BadEntity
+	for i, name := range names {
+		matched, err := toRedisEntities(name, values[i].Val(), now)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, matched...)
+	}
+
+	return entities, nil
+}
+
+func (x *redisRepository) Del(name string) error {
+	return x.DelContext(context.Background(), name)
+}
+
+func (x *redisRepository) DelContext(ctx context.Context, name string) error {
+	client := x.client.WithContext(ctx)
+	srcs, err := client.HKeys(x.entityKey(name)).Result()
+	if err != nil {
+		return errors.Wrapf(err, "Fail to get Src of %s from Redis", name)
+	}
+
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(x.entityKey(name))
+		for _, src := range srcs {
+			pipe.SRem(x.srcKey(src), name)
+		}
+		for _, netKey := range x.networkKeys(name) {
+			pipe.SRem(netKey, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Fail to delete %s from Redis", name)
+	}
+
+	return nil
+}
+
+func (x *redisRepository) Prune(src string, before time.Time) error {
+	return x.PruneContext(context.Background(), src, before)
+}
+
+// PruneContext scans index of src by SSCAN and deletes entities that have LastSeen before given time. Names of which keys have been expired are also removed from indexes.
+func (x *redisRepository) PruneContext(ctx context.Context, src string, before time.Time) error {
+	client := x.client.WithContext(ctx)
+	srcKey := x.srcKey(src)
+
+	var cursor uint64
+	for {
+		names, next, err := client.SScan(srcKey, cursor, "", redisScanCount).Result()
+		if err != nil {
+			return errors.Wrapf(err, "Fail to scan Src index of %s", src)
+		}
+
+		if err := x.prune(client, src, names, before); err != nil {
+			return err
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (x *redisRepository) prune(client *redis.Client, src string, names []string, before time.Time) error {
+	values := make([]*redis.StringCmd, len(names))
+	_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, name := range names {
+			values[i] = pipe.HGet(x.entityKey(name), src)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "Fail to get entities of %s from Redis", src)
+	}
+
+	var targets []string
+	for i, name := range names {
+		raw, err := values[i].Result()
+		if err == redis.Nil {
+			targets = append(targets, name)
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "Fail to get entity of %s from Redis", name)
+		}
+
+		entity, err := decodeRedisEntity(raw)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid entity of %s in Redis", name)
+		}
+		if entity.LastSeen.Before(before) {
+			targets = append(targets, name)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	remains := make([]*redis.IntCmd, len(targets))
+	_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, name := range targets {
+			pipe.HDel(x.entityKey(name), src)
+			pipe.SRem(x.srcKey(src), name)
+			remains[i] = pipe.HLen(x.entityKey(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Fail to prune entities of %s in Redis", src)
+	}
+
+	// Remove network index of names that have no more entities.
+	_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, name := range targets {
+			if remains[i].Val() > 0 {
+				continue
+			}
+			for _, netKey := range x.networkKeys(name) {
+				pipe.SRem(netKey, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Fail to remove network index of %s in Redis", src)
+	}
+
+	return nil
+}
+
+func (x *redisRepository) Dump() chan *EntityQueue {
+	return x.DumpContext(context.Background())
+}
+
+// DumpContext iterates keys of names by SCAN. One EntityQueue has entities of one name. A key may be returned more than once by SCAN if keys are modified during iteration.
+func (x *redisRepository) DumpContext(ctx context.Context) chan *EntityQueue {
+	ch := make(chan *EntityQueue)
+	client := x.client.WithContext(ctx)
+	keyPrefix := x.entityKey("")
+
+	go func() {
+		defer close(ch)
+
+		send := func(q *EntityQueue) bool {
+			select {
+			case ch <- q:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(cursor, keyPrefix+"*", redisScanCount).Result()
+			if err != nil {
+				send(&EntityQueue{Error: errors.Wrap(err, "Fail to scan keys in Redis")})
+				return
+			}
+
+			values := make([]*redis.StringStringMapCmd, len(keys))
+			_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+				for i, key := range keys {
+					values[i] = pipe.HGetAll(key)
+				}
+				return nil
+			})
+			if err != nil {
+				send(&EntityQueue{Error: errors.Wrap(err, "Fail to get entities from Redis")})
+				return
+			}
+
+			now := time.Now()
+			for i, key := range keys {
+				entities, err := toRedisEntities(key[len(keyPrefix):], values[i].Val(), now)
+				if err != nil {
+					send(&EntityQueue{Error: err})
+					return
+				}
+				if len(entities) == 0 {
+					continue
+				}
+
+				q := &EntityQueue{}
+				for j := range entities {
+					q.Entities = append(q.Entities, &entities[j])
+				}
+				if !send(q) {
+					return
+				}
+			}
+
+			if next == 0 {
+				return
+			}
+			cursor = next
+		}
+	}()
+
+	return ch
+}
@@ -1,203 +1,1088 @@
 package badman
 
 import (
+	"context"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/guregu/dynamo"
 	"github.com/pkg/errors"
 )
 
-// BadEntity is IP address or domain name that is appeared in BlackList. Name indicates both IP address and domain name.
+// ErrNotSupported is returned (with wrapping) by a method of Repository that is not supported by the backend. Use errors.Cause to compare.
+var ErrNotSupported = errors.New("Not supported by the repository")
+
+// BadEntity is IP address, network or domain name that is appeared in BlackList. Name indicates IP address, CIDR (e.g. "192.0.2.0/24"), IP address range (e.g. "192.0.2.1-192.0.2.20") and domain name.
 type BadEntity struct {
 	Name    string
+	Kind    EntityKind
 	SavedAt time.Time
 	Src     string
 	Reason  string // optional
+
+	// ExpiresAt is time when the entity becomes stale and should be removed. Zero value means the entity never expires.
+	ExpiresAt time.Time
+
+	// FirstSeen and LastSeen are time when the entity was put into repository at first and at last. Sightings is number of times that the entity was put. Repository merges them with existing entity of same Name and Src instead of replacing. Time of Put and 1 are used if they are zero.
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Sightings int
 }
 
-// Repository is interface of data store.
+// Expired returns true if ExpiresAt is set and it's not after now.
+func (x BadEntity) Expired(now time.Time) bool {
+	return !x.ExpiresAt.IsZero() && !x.ExpiresAt.After(now)
+}
+
+// sighted returns a copy of entity that has FirstSeen, LastSeen and Sightings. now and 1 are used if they are not set.
+func sighted(entity BadEntity, now time.Time) BadEntity {
+	if entity.LastSeen.IsZero() {
+		entity.LastSeen = now
+	}
+	if entity.FirstSeen.IsZero() {
+		entity.FirstSeen = entity.LastSeen
+	}
+	if entity.Sightings <= 0 {
+		entity.Sightings = 1
+	}
+	return entity
+}
+
+// isFreshSighting returns true if entity is a new sighting (e.g. from Download) that has no history. Entity that has Sightings carries history of other repository (e.g. by Load, delta or migrate).
+func isFreshSighting(entity *BadEntity) bool {
+	return entity.Sightings <= 0
+}
+
+// mergeSighting returns newer entity that has merged FirstSeen, LastSeen and Sightings of older one. Sightings of older is incremented if newer is fresh sighting. Otherwise larger Sightings is kept not to count same history twice when a dump is loaded again.
+func mergeSighting(older, newer BadEntity, fresh bool) BadEntity {
+	if older.FirstSeen.Before(newer.FirstSeen) {
+		newer.FirstSeen = older.FirstSeen
+	}
+	if older.LastSeen.After(newer.LastSeen) {
+		newer.LastSeen = older.LastSeen
+	}
+	if fresh {
+		newer.Sightings += older.Sightings
+	} else if older.Sightings > newer.Sightings {
+		newer.Sightings = older.Sightings
+	}
+	return newer
+}
+
+// Repository is interface of data store. BadMan normalizes names by NormalizeName before passing them to Repository.
 type Repository interface {
 	Put(entities []*BadEntity) error
 	Get(name string) ([]BadEntity, error)
+	// GetNetworks returns entities of CIDR and IP address range that contain addr. Entities of longer prefix should come first.
+	GetNetworks(addr net.IP) ([]BadEntity, error)
 	Del(name string) error
+	// Prune deletes entities of src that have LastSeen before given time.
+	Prune(src string, before time.Time) error
 	Dump() chan *EntityQueue
 }
 
-// inMemoryRepository is in-memory type repository.
+// RepositoryContext is Repository that supports cancellation by context.Context. BadMan uses methods of RepositoryContext if a repository implements it.
+type RepositoryContext interface {
+	Repository
+	PutContext(ctx context.Context, entities []*BadEntity) error
+	GetContext(ctx context.Context, name string) ([]BadEntity, error)
+	GetNetworksContext(ctx context.Context, addr net.IP) ([]BadEntity, error)
+	DelContext(ctx context.Context, name string) error
+	PruneContext(ctx context.Context, src string, before time.Time) error
+	// DumpContext should close the channel when ctx is done.
+	DumpContext(ctx context.Context) chan *EntityQueue
+}
+
+// withContext returns repo as RepositoryContext. If repo does not implement RepositoryContext, ctx is checked only before calling methods of repo.
+func withContext(repo Repository) RepositoryContext {
+	if r, ok := repo.(RepositoryContext); ok {
+		return r
+	}
+	return &contextAdapter{Repository: repo}
+}
+
+type contextAdapter struct {
+	Repository
+}
+
+func (x *contextAdapter) PutContext(ctx context.Context, entities []*BadEntity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return x.Put(entities)
+}
+
+func (x *contextAdapter) GetContext(ctx context.Context, name string) ([]BadEntity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return x.Get(name)
+}
+
+func (x *contextAdapter) GetNetworksContext(ctx context.Context, addr net.IP) ([]BadEntity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return x.GetNetworks(addr)
+}
+
+func (x *contextAdapter) DelContext(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return x.Del(name)
+}
+
+func (x *contextAdapter) PruneContext(ctx context.Context, src string, before time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return x.Prune(src, before)
+}
+
+func (x *contextAdapter) DumpContext(ctx context.Context) chan *EntityQueue {
+	ch := x.Dump()
+	if ch == nil {
+		return nil
+	}
+	return forwardContext(ctx, ch)
+}
+
+// forwardContext forwards messages from ch to returned channel until ctx is done. ch is drained after ctx is done to release the sender.
+func forwardContext(ctx context.Context, ch chan *EntityQueue) chan *EntityQueue {
+	out := make(chan *EntityQueue)
+	go func() {
+		defer close(out)
+		for q := range ch {
+			select {
+			case out <- q:
+			case <-ctx.Done():
+				for range ch {
+				}
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// inMemoryRepository is in-memory type repository. It's safe for concurrent use. Entities are distributed to shards by hash of name and each shard has own lock so that Get is not blocked by Put of other shards during bulk load.
 type inMemoryRepository struct {
+	// lastEvicted is accessed atomically and must be 64-bit aligned as first field.
+	lastEvicted   int64 // unix nano
+	evicting      int32
+	evictInterval time.Duration
+
+	shards []*inMemoryShard
+
+	netLock  sync.RWMutex
+	networks *ipTrie
+}
+
+type inMemoryShard struct {
+	lock sync.RWMutex
 	data map[string]map[string]BadEntity
 }
 
-// NewInMemoryRepository is constructor of inMemoryRepository
+const (
+	// inMemoryEvictInterval is minimum interval of sweeping expired entities in inMemoryRepository.
+	inMemoryEvictInterval = time.Minute
+	// inMemoryShardNum is number of shards of inMemoryRepository.
+	inMemoryShardNum = 64
+)
+
+// NewInMemoryRepository is constructor of inMemoryRepository. Expiry is lazy: expired entities are never returned, but they are removed from memory only by a sweep that Put or Get starts in background at most once in a minute. There is no timer, then memory of expired entities is kept while the repository is idle.
 func NewInMemoryRepository() Repository {
-	repo := &inMemoryRepository{}
+	repo := &inMemoryRepository{
+		evictInterval: inMemoryEvictInterval,
+	}
 	repo.init()
 	return repo
 }
 
 func (x *inMemoryRepository) init() {
-	x.data = make(map[string]map[string]BadEntity)
+	x.shards = make([]*inMemoryShard, inMemoryShardNum)
+	for i := range x.shards {
+		x.shards[i] = &inMemoryShard{data: make(map[string]map[string]BadEntity)}
+	}
+	x.networks = newIPTrie()
+	x.lastEvicted = time.Now().UnixNano()
+}
+
+func (x *inMemoryRepository) shard(name string) *inMemoryShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return x.shards[h.Sum32()%uint32(len(x.shards))]
 }
 
 func (x *inMemoryRepository) Put(entities []*BadEntity) error {
-	for i := range entities {
-		srcMap, ok := x.data[entities[i].Name]
-		if !ok {
-			srcMap = make(map[string]BadEntity)
-			x.data[entities[i].Name] = srcMap
+	// Group entities by shard to acquire each lock only once.
+	groups := map[*inMemoryShard][]*BadEntity{}
+	for _, entity := range entities {
+		shard := x.shard(entity.Name)
+		groups[shard] = append(groups[shard], entity)
+	}
+
+	now := time.Now()
+	for shard, group := range groups {
+		shard.lock.Lock()
+		for _, e := range group {
+			srcMap, ok := shard.data[e.Name]
+			if !ok {
+				srcMap = make(map[string]BadEntity)
+				shard.data[e.Name] = srcMap
+
+				if networks := parseNetworks(e.Name); networks != nil {
+					x.netLock.Lock()
+					for _, network := range networks {
+						x.networks.insert(network, e.Name)
+					}
+					x.netLock.Unlock()
+				}
+			}
+
+			entity := sighted(*e, now)
+			if old, ok := srcMap[entity.Src]; ok && !old.Expired(now) {
+				entity = mergeSighting(old, entity, isFreshSighting(e))
+			}
+			srcMap[entity.Src] = entity
 		}
-		srcMap[entities[i].Src] = *entities[i]
+		shard.lock.Unlock()
 	}
+
+	x.evictIfNeeded()
 	return nil
 }
 
 func (x *inMemoryRepository) Get(name string) ([]BadEntity, error) {
-	srcMap, ok := x.data[name]
-	if !ok {
-		return nil, nil
+	entities := x.get(name, time.Now())
+	x.evictIfNeeded()
+	return entities, nil
+}
+
+func (x *inMemoryRepository) get(name string, now time.Time) []BadEntity {
+	shard := x.shard(name)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	var entities []BadEntity
+	for _, entity := range shard.data[name] {
+		if !entity.Expired(now) {
+			entities = append(entities, entity)
+		}
 	}
 
+	return entities
+}
+
+func (x *inMemoryRepository) GetNetworks(addr net.IP) ([]BadEntity, error) {
+	x.netLock.RLock()
+	names := x.networks.lookup(addr)
+	x.netLock.RUnlock()
+
+	now := time.Now()
 	var entities []BadEntity
-	for _, entity := range srcMap {
-		entities = append(entities, entity)
+	for _, name := range names {
+		entities = append(entities, x.get(name, now)...)
 	}
 
 	return entities, nil
 }
 
 func (x *inMemoryRepository) Del(name string) error {
-	delete(x.data, name)
+	shard := x.shard(name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	x.del(shard, name)
+	return nil
+}
+
+// del removes name from shard and network trie. Caller must hold the lock of shard.
+func (x *inMemoryRepository) del(shard *inMemoryShard, name string) {
+	if networks := parseNetworks(name); networks != nil {
+		x.netLock.Lock()
+		for _, network := range networks {
+			x.networks.remove(network, name)
+		}
+		x.netLock.Unlock()
+	}
+	delete(shard.data, name)
+}
+
+func (x *inMemoryRepository) Prune(src string, before time.Time) error {
+	for _, shard := range x.shards {
+		shard.lock.Lock()
+		for name, srcMap := range shard.data {
+			if entity, ok := srcMap[src]; ok && entity.LastSeen.Before(before) {
+				delete(srcMap, src)
+				if len(srcMap) == 0 {
+					x.del(shard, name)
+				}
+			}
+		}
+		shard.lock.Unlock()
+	}
+
 	return nil
 }
 
 func (x *inMemoryRepository) Dump() chan *EntityQueue {
+	return x.DumpContext(context.Background())
+}
+
+func (x *inMemoryRepository) PutContext(ctx context.Context, entities []*BadEntity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return x.Put(entities)
+}
+
+func (x *inMemoryRepository) GetContext(ctx context.Context, name string) ([]BadEntity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return x.Get(name)
+}
+
+func (x *inMemoryRepository) GetNetworksContext(ctx context.Context, addr net.IP) ([]BadEntity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return x.GetNetworks(addr)
+}
+
+func (x *inMemoryRepository) DelContext(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return x.Del(name)
+}
+
+func (x *inMemoryRepository) PruneContext(ctx context.Context, src string, before time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return x.Prune(src, before)
+}
+
+func (x *inMemoryRepository) DumpContext(ctx context.Context) chan *EntityQueue {
+	return x.Iterate(ctx, EntityFilter{})
+}
+
+// snapshot returns copy of entities that are not expired at now and match filter. One EntityQueue has entities of one name.
+func (x *inMemoryShard) snapshot(now time.Time, filter EntityFilter) []*EntityQueue {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+
+	var queues []*EntityQueue
+	for _, srcMap := range x.data {
+		var q EntityQueue
+		for _, entity := range srcMap {
+			if !entity.Expired(now) && filter.Match(&entity) {
+				e := entity
+				q.Entities = append(q.Entities, &e)
+			}
+		}
+		if len(q.Entities) > 0 {
+			queues = append(queues, &q)
+		}
+	}
+	return queues
+}
+
+// Count counts entities under read lock of each shard without copying them.
+func (x *inMemoryRepository) Count(ctx context.Context, filter EntityFilter) (*RepositoryStats, error) {
+	stats := newRepositoryStats()
+	now := time.Now()
+	for _, shard := range x.shards {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		shard.lock.RLock()
+		for _, srcMap := range shard.data {
+			for _, entity := range srcMap {
+				if !entity.Expired(now) && filter.Match(&entity) {
+					stats.add(&entity)
+				}
+			}
+		}
+		shard.lock.RUnlock()
+	}
+	return stats, nil
+}
+
+func (x *inMemoryRepository) Iterate(ctx context.Context, filter EntityFilter) chan *EntityQueue {
 	ch := make(chan *EntityQueue)
 	go func() {
 		defer close(ch)
-		for _, srcMap := range x.data {
-			var q EntityQueue
-			for _, entity := range srcMap {
-				q.Entities = append(q.Entities, &entity)
+		for _, shard := range x.shards {
+			// Copy entities of a shard before sending to channel not to keep lock while a receiver is working.
+			for _, q := range shard.snapshot(time.Now(), filter) {
+				select {
+				case ch <- q:
+				case <-ctx.Done():
+					return
+				}
 			}
-			ch <- &q
 		}
 	}()
 	return ch
 }
 
+// evictIfNeeded starts evict in background if evictInterval has passed since last eviction. It's called only by Put and Get, there is no periodic sweep.
+func (x *inMemoryRepository) evictIfNeeded() {
+	last := time.Unix(0, atomic.LoadInt64(&x.lastEvicted))
+	if time.Since(last) < x.evictInterval {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&x.evicting, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&x.evicting, 0)
+		x.evict(time.Now())
+	}()
+}
+
+// evict removes expired entities. Shards are locked one by one not to block all lookups.
+func (x *inMemoryRepository) evict(now time.Time) {
+	for _, shard := range x.shards {
+		shard.lock.Lock()
+		for name, srcMap := range shard.data {
+			for src, entity := range srcMap {
+				if entity.Expired(now) {
+					delete(srcMap, src)
+				}
+			}
+			if len(srcMap) == 0 {
+				x.del(shard, name)
+			}
+		}
+		shard.lock.Unlock()
+	}
+
+	atomic.StoreInt64(&x.lastEvicted, now.UnixNano())
+}
+
 type dynamoRepository struct {
 	table dynamo.Table
 	msgCh chan *EntityQueue
+
+	client           dynamodbiface.DynamoDBAPI
+	scanSegments     int
+	scanReadCapacity float64
+	maxRetries       int
+	retryInterval    time.Duration
+	sourceIndex      string
+}
+
+// DynamoConfig is configuration of dynamoRepository.
+type DynamoConfig struct {
+	Region    string
+	TableName string
+
+	// Endpoint overrides endpoint of DynamoDB, e.g. "http://localhost:8000" for DynamoDB Local.
+	Endpoint string
+	// Credentials is used instead of default credential chain of AWS SDK if it's set.
+	Credentials *credentials.Credentials
+
+	// MaxRetries is max number of retries of unprocessed items in batch write. Interval of retries grows exponentially. Default is 8.
+	MaxRetries int
+
+	// ScanSegments is number of segments that are scanned in parallel by Dump. Default is 4.
+	ScanSegments int
+	// ScanReadCapacity limits read capacity units per second that are consumed by Dump in total of all segments, so that Dump does not exhaust capacity for Get. Zero value means unlimited.
+	ScanReadCapacity float64
+
+	// SourceIndex is name of global secondary index that has "src" as hash key and "name" as range key with all attributes projected. CreateDynamoTable creates it as DynamoSourceIndex. If it's set, Prune, Count and Iterate with Src of EntityFilter query the index instead of scanning the table.
+	SourceIndex string
 }
 
+const (
+	// dynamoDefaultScanSegments is default value of DynamoConfig.ScanSegments.
+	dynamoDefaultScanSegments = 4
+	// dynamoDefaultMaxRetries is default value of DynamoConfig.MaxRetries.
+	dynamoDefaultMaxRetries = 8
+	// dynamoRetryInterval is first interval of retry of unprocessed items. It's doubled by every retry up to dynamoMaxRetryInterval.
+	dynamoRetryInterval    = 50 * time.Millisecond
+	dynamoMaxRetryInterval = 5 * time.Second
+	// dynamoBatchWriteSize is max number of items in one BatchWriteItem request.
+	dynamoBatchWriteSize = 25
+	// dynamoIterateChunkSize is max number of entities in one EntityQueue of Iterate.
+	dynamoIterateChunkSize = 100
+
+	// DynamoSourceIndex is name of global secondary index of "src" that is created by CreateDynamoTable.
+	DynamoSourceIndex = "src-index"
+)
+
 type dynamoEntityItem struct {
-	Name    string    `dynamo:"name"`
-	Src     string    `dynamo:"src"`
-	SavedAt time.Time `dynamo:"saved_at"`
-	Reason  string    `dynamo:"reason"`
+	Name    string     `dynamo:"name"`
+	Src     string     `dynamo:"src"`
+	Kind    EntityKind `dynamo:"kind"`
+	SavedAt time.Time  `dynamo:"saved_at"`
+	Reason  string     `dynamo:"reason"`
+
+	// ExpiresAt is stored as unix time for TTL of DynamoDB. Enable TTL with "expires_at" attribute on the table to delete expired items automatically.
+	ExpiresAt time.Time `dynamo:"expires_at,unixtime"`
+
+	FirstSeen time.Time `dynamo:"first_seen"`
+	LastSeen  time.Time `dynamo:"last_seen"`
+	Sightings int       `dynamo:"sightings"`
+}
+
+func newDynamoEntityItem(entity BadEntity) *dynamoEntityItem {
+	return &dynamoEntityItem{
+		Name:    entity.Name,
+		Src:     entity.Src,
+		Kind:    entity.Kind,
+		SavedAt: entity.SavedAt,
+		Reason:  entity.Reason,
+
+		ExpiresAt: entity.ExpiresAt,
+		FirstSeen: entity.FirstSeen,
+		LastSeen:  entity.LastSeen,
+		Sightings: entity.Sightings,
+	}
+}
+
+func (x *dynamoEntityItem) toEntity() BadEntity {
+	return BadEntity{
+		Name:    x.Name,
+		Src:     x.Src,
+		Kind:    x.Kind,
+		SavedAt: x.SavedAt,
+		Reason:  x.Reason,
+
+		ExpiresAt: x.ExpiresAt,
+		FirstSeen: x.FirstSeen,
+		LastSeen:  x.LastSeen,
+		Sightings: x.Sightings,
+	}
 }
 
-const dynamoBatchSize = 25
+// dynamoPutConcurrency is number of parallel BatchWriteItem requests in Put.
+const dynamoPutConcurrency = 16
 
-// NewDynamoRepository is constructor of dynamoRepository
+// NewDynamoRepository is constructor of dynamoRepository with default configuration. It panics if AWS session can not be created.
 func NewDynamoRepository(region, tableName string) Repository {
-	ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(region)}))
-	db := dynamo.New(ssn)
+	repo, err := NewDynamoRepositoryWithConfig(DynamoConfig{
+		Region:    region,
+		TableName: tableName,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return repo
+}
+
+// NewDynamoRepositoryWithConfig is constructor of dynamoRepository with DynamoConfig.
+func NewDynamoRepositoryWithConfig(config DynamoConfig) (Repository, error) {
+	if config.TableName == "" {
+		return nil, errors.New("TableName is required for DynamoDB repository")
+	}
+	if config.ScanSegments < 0 || config.ScanReadCapacity < 0 {
+		return nil, errors.Errorf("Invalid scan config, segments: %d, read capacity: %f", config.ScanSegments, config.ScanReadCapacity)
+	}
+	if config.MaxRetries < 0 {
+		return nil, errors.Errorf("Invalid MaxRetries: %d", config.MaxRetries)
+	}
+
+	db, err := newDynamoDB(config)
+	if err != nil {
+		return nil, err
+	}
 
 	repo := &dynamoRepository{
-		table: db.Table(tableName),
-		msgCh: make(chan *EntityQueue),
+		table:            db.Table(config.TableName),
+		msgCh:            make(chan *EntityQueue),
+		client:           db.Client(),
+		scanSegments:     config.ScanSegments,
+		scanReadCapacity: config.ScanReadCapacity,
+		maxRetries:       config.MaxRetries,
+		retryInterval:    dynamoRetryInterval,
+		sourceIndex:      config.SourceIndex,
+	}
+	if repo.scanSegments == 0 {
+		repo.scanSegments = dynamoDefaultScanSegments
+	}
+	if repo.maxRetries == 0 {
+		repo.maxRetries = dynamoDefaultMaxRetries
 	}
 
-	return repo
+	return repo, nil
 }
 
-func (x *dynamoRepository) flush(items []interface{}) error {
-	wrote, err := x.table.Batch().Write().Put(items...).Run()
+func newDynamoDB(config DynamoConfig) (*dynamo.DB, error) {
+	awsConfig := &aws.Config{Region: aws.String(config.Region)}
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	if config.Credentials != nil {
+		awsConfig.Credentials = config.Credentials
+	}
+
+	ssn, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to create AWS session")
+	}
+	return dynamo.New(ssn), nil
+}
+
+// CreateDynamoTable creates a table for dynamoRepository by Region, TableName, Endpoint and Credentials of config. The table has "name" as hash key and "src" as range key, global secondary index DynamoSourceIndex of "src", and uses on-demand capacity. It waits until the table becomes active. Enable TTL with "expires_at" attribute after creation to delete expired items automatically.
+func CreateDynamoTable(ctx context.Context, config DynamoConfig) error {
+	if config.TableName == "" {
+		return errors.New("TableName is required for DynamoDB repository")
+	}
+
+	db, err := newDynamoDB(config)
 	if err != nil {
-		return errors.Wrapf(err, "Fail to flush DynamoRepository: %v", items)
+		return err
+	}
+
+	type tableSchema struct {
+		Name string `dynamo:"name,hash" index:"src-index,range"`
+		Src  string `dynamo:"src,range" index:"src-index,hash"`
 	}
-	if wrote != len(items) {
-		return errors.Wrapf(err, "Invalid wrote item number, expect %d but actual %d", len(items), wrote)
+	create := db.CreateTable(config.TableName, tableSchema{}).
+		Project(DynamoSourceIndex, dynamo.AllProjection).
+		OnDemand(true)
+	if err := create.RunWithContext(ctx); err != nil {
+		return errors.Wrapf(err, "Fail to create DynamoDB table: %s", config.TableName)
 	}
 
+	input := &dynamodb.DescribeTableInput{TableName: aws.String(config.TableName)}
+	if err := db.Client().WaitUntilTableExistsWithContext(ctx, input); err != nil {
+		return errors.Wrapf(err, "Fail to wait for DynamoDB table: %s", config.TableName)
+	}
+
+	return nil
+}
+
+// overwrite puts entities by BatchWriteItem. Existing items are replaced, then entities must be merged with existing items in advance.
+func (x *dynamoRepository) overwrite(ctx context.Context, entities []BadEntity) error {
+	requests := make([]*dynamodb.WriteRequest, len(entities))
+	for i, entity := range entities {
+		item, err := dynamo.MarshalItem(newDynamoEntityItem(entity))
+		if err != nil {
+			return errors.Wrapf(err, "Fail to marshal entity for DynamoDB: %v", entity)
+		}
+		requests[i] = &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}}
+	}
+
+	if err := x.batchWrite(ctx, requests); err != nil {
+		return errors.Wrap(err, "Fail to put entities to DynamoDB")
+	}
 	return nil
 }
 
 func (x *dynamoRepository) Put(entities []*BadEntity) error {
-	var items []interface{}
+	return x.PutContext(context.Background(), entities)
+}
 
-	for i := 0; i < len(entities); i++ {
+// PutContext of dynamoRepository gets existing items by BatchGetItem, merges sightings in memory and writes merged items by BatchWriteItem in chunks of dynamoBatchWriteSize with dynamoPutConcurrency workers. History of expired items is not merged as other repositories. Like redisRepository, read and write are not atomic, then a sighting may be lost by concurrent Put of same entity.
+func (x *dynamoRepository) PutContext(ctx context.Context, entities []*BadEntity) error {
+	if len(entities) == 0 {
+		return nil
+	}
 
-		item := dynamoEntityItem{
-			Name:    entities[i].Name,
-			Src:     entities[i].Src,
-			SavedAt: entities[i].SavedAt,
-			Reason:  entities[i].Reason,
+	// BatchWriteItem does not accept same key twice in a request, then entities are grouped by key and merged in order.
+	type dynamoPutGroup struct {
+		key      [2]string
+		entities []*BadEntity
+	}
+	var groups []*dynamoPutGroup
+	index := map[[2]string]*dynamoPutGroup{}
+	for _, e := range entities {
+		key := [2]string{e.Name, e.Src}
+		group, ok := index[key]
+		if !ok {
+			group = &dynamoPutGroup{key: key}
+			index[key] = group
+			groups = append(groups, group)
 		}
-		items = append(items, item)
+		group.entities = append(group.entities, e)
+	}
 
-		if len(items) >= dynamoBatchSize {
-			if err := x.flush(items); err != nil {
-				return err
+	keys := make([]dynamo.Keyed, len(groups))
+	for i, group := range groups {
+		keys[i] = dynamo.Keys{group.key[0], group.key[1]}
+	}
+	var items []dynamoEntityItem
+	err := x.table.Batch("name", "src").Get(keys...).AllWithContext(ctx, &items)
+	if err != nil && err != dynamo.ErrNotFound {
+		return errors.Wrap(err, "Fail to get existing entities from DynamoDB")
+	}
+	olds := make(map[[2]string]BadEntity, len(items))
+	for _, item := range items {
+		olds[[2]string{item.Name, item.Src}] = item.toEntity()
+	}
+
+	now := time.Now()
+	merged := make([]BadEntity, len(groups))
+	for i, group := range groups {
+		old, exists := olds[group.key]
+		exists = exists && !old.Expired(now)
+		for _, e := range group.entities {
+			entity := sighted(*e, now)
+			if exists {
+				entity = mergeSighting(old, entity, isFreshSighting(e))
 			}
-			items = []interface{}{}
+			old, exists = entity, true
 		}
+		merged[i] = old
+	}
 
+	var chunks [][]BadEntity
+	for i := 0; i < len(merged); i += dynamoBatchWriteSize {
+		end := i + dynamoBatchWriteSize
+		if end > len(merged) {
+			end = len(merged)
+		}
+		chunks = append(chunks, merged[i:end])
 	}
 
-	if len(items) > 0 {
-		if err := x.flush(items); err != nil {
-			return err
+	chunkCh := make(chan []BadEntity)
+	errCh := make(chan error, dynamoPutConcurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < dynamoPutConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunkCh {
+				if err := x.overwrite(ctx, chunk); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+
+	err = nil
+	for i := 0; i < len(chunks) && err == nil; i++ {
+		select {
+		case chunkCh <- chunks[i]:
+		case err = <-errCh:
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
 	}
+	close(chunkCh)
+	wg.Wait()
 
-	return nil
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-errCh:
+		return err
+	default:
+		return nil
+	}
 }
 
 func (x *dynamoRepository) Get(name string) ([]BadEntity, error) {
+	return x.GetContext(context.Background(), name)
+}
+
+func (x *dynamoRepository) GetContext(ctx context.Context, name string) ([]BadEntity, error) {
 	var items []dynamoEntityItem
-	err := x.table.Get("name", name).All(&items)
+	err := x.table.Get("name", name).AllWithContext(ctx, &items)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Fail to get entities from DynamoDB: %s", name)
 	}
 
+	// TTL of DynamoDB deletes expired items within a few days. Then expired items must be removed here.
+	now := time.Now()
 	var entities []BadEntity
 	for _, item := range items {
-		entities = append(entities, BadEntity{
-			Name:    item.Name,
-			Src:     item.Src,
-			SavedAt: item.SavedAt,
-			Reason:  item.Reason,
-		})
+		entity := item.toEntity()
+		if !entity.Expired(now) {
+			entities = append(entities, entity)
+		}
 	}
 
 	return entities, nil
 }
 
+func (x *dynamoRepository) GetNetworks(addr net.IP) ([]BadEntity, error) {
+	return x.GetNetworksContext(context.Background(), addr)
+}
+
+func (x *dynamoRepository) GetNetworksContext(ctx context.Context, addr net.IP) ([]BadEntity, error) {
+	// GetNetworks is not supported for DynamoDB because searching covering networks requires query for every prefix length.
+	return nil, errors.Wrap(ErrNotSupported, "dynamoRepository does not support GetNetworks")
+}
+
 func (x *dynamoRepository) Del(name string) error {
+	return x.DelContext(context.Background(), name)
+}
+
+func (x *dynamoRepository) DelContext(ctx context.Context, name string) error {
 	var items []dynamoEntityItem
-	if err := x.table.Get("name", name).All(&items); err != nil {
+	if err := x.table.Get("name", name).AllWithContext(ctx, &items); err != nil {
 		return errors.Wrapf(err, "Fail to get entities for deleteItems from DynamoDB: %s", name)
 	}
 
-	var keys []dynamo.Keyed
+	var keys []dynamoEntityItem
 	for _, item := range items {
-		keys = append(keys, &dynamo.Keys{item.Name, item.Src})
+		keys = append(keys, dynamoEntityItem{Name: item.Name, Src: item.Src})
+	}
+
+	if err := x.batchDelete(ctx, keys); err != nil {
+		return errors.Wrapf(err, "Fail to delete entity from DynamoDB: %s", name)
 	}
 
-	if wrote, err := x.table.Batch("name", "src").Write().Delete(keys...).Run(); err != nil {
-		return errors.Wrapf(err, "Fail to delete entity from DynamoDB: %s (%v)", name, keys)
-	} else if wrote != len(keys) {
-		return errors.Wrapf(err, "Invalid delete item number, expect %d but actual %d", len(keys), wrote)
+	return nil
+}
+
+// batchDelete deletes items of keys by BatchWriteItem. keys are split into chunks of dynamoBatchWriteSize.
+func (x *dynamoRepository) batchDelete(ctx context.Context, keys []dynamoEntityItem) error {
+	for i := 0; i < len(keys); i += dynamoBatchWriteSize {
+		end := i + dynamoBatchWriteSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var requests []*dynamodb.WriteRequest
+		for _, key := range keys[i:end] {
+			requests = append(requests, &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{
+					Key: map[string]*dynamodb.AttributeValue{
+						"name": {S: aws.String(key.Name)},
+						"src":  {S: aws.String(key.Src)},
+					},
+				},
+			})
+		}
+
+		if err := x.batchWrite(ctx, requests); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// batchWrite sends requests by BatchWriteItem. UnprocessedItems are retried with exponential backoff up to maxRetries times, and error is returned if some items remain unprocessed.
+func (x *dynamoRepository) batchWrite(ctx context.Context, requests []*dynamodb.WriteRequest) error {
+	tableName := x.table.Name()
+	interval := x.retryInterval
+
+	for retry := 0; ; retry++ {
+		input := &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{tableName: requests},
+		}
+		resp, err := x.client.BatchWriteItemWithContext(ctx, input)
+		if err != nil {
+			return errors.Wrap(err, "Fail to write batch to DynamoDB")
+		}
+
+		requests = resp.UnprocessedItems[tableName]
+		if len(requests) == 0 {
+			return nil
+		}
+		if retry >= x.maxRetries {
+			return errors.Errorf("%d items are still unprocessed after %d retries", len(requests), retry)
+		}
+
+		if err := aws.SleepWithContext(ctx, interval); err != nil {
+			return err
+		}
+		if interval *= 2; interval > dynamoMaxRetryInterval {
+			interval = dynamoMaxRetryInterval
+		}
+	}
+}
+
+func (x *dynamoRepository) Prune(src string, before time.Time) error {
+	return x.PruneContext(context.Background(), src, before)
+}
+
+func (x *dynamoRepository) PruneContext(ctx context.Context, src string, before time.Time) error {
+	var items []dynamoEntityItem
+	if x.sourceIndex != "" {
+		if err := x.table.Get("src", src).Index(x.sourceIndex).AllWithContext(ctx, &items); err != nil {
+			return errors.Wrapf(err, "Fail to query entities of %s in DynamoDB", src)
+		}
+	} else {
+		// Scan is required because the table has no index of src.
+		if err := x.table.Scan().Filter("'src' = ?", src).AllWithContext(ctx, &items); err != nil {
+			return errors.Wrapf(err, "Fail to scan entities of %s in DynamoDB", src)
+		}
+	}
+
+	var keys []dynamoEntityItem
+	for _, item := range items {
+		if item.LastSeen.Before(before) {
+			keys = append(keys, dynamoEntityItem{Name: item.Name, Src: item.Src})
+		}
+	}
+
+	if err := x.batchDelete(ctx, keys); err != nil {
+		return errors.Wrapf(err, "Fail to prune entities of %s from DynamoDB", src)
 	}
 
 	return nil
 }
 
 func (x *dynamoRepository) Dump() chan *EntityQueue {
-	// Dump is not supported for DynamoDB because Scan requries massive resource against blacklist.
+	return x.DumpContext(context.Background())
+}
+
+// DumpContext scans the table by parallel segmented Scan. Each segment sends entities of a page as an EntityQueue, so that order of entities is not defined. When a segment fails, the error is sent and other segments are stopped.
+func (x *dynamoRepository) DumpContext(ctx context.Context) chan *EntityQueue {
+	ch := make(chan *EntityQueue)
+	ctx, cancel := context.WithCancel(ctx)
+	limiter := newCapacityLimiter(x.scanReadCapacity)
+
+	var wg sync.WaitGroup
+	for segment := 0; segment < x.scanSegments; segment++ {
+		wg.Add(1)
+		go func(segment int) {
+			defer wg.Done()
+			if err := x.scanSegment(ctx, segment, limiter, ch); err != nil && ctx.Err() == nil {
+				select {
+				case ch <- &EntityQueue{Error: err}:
+				case <-ctx.Done():
+				}
+				cancel()
+			}
+		}(segment)
+	}
+
+	go func() {
+		wg.Wait()
+		cancel()
+		close(ch)
+	}()
+
+	return ch
+}
+
+// scanSegment scans one segment of the table page by page and sends entities that are not expired.
+func (x *dynamoRepository) scanSegment(ctx context.Context, segment int, limiter *capacityLimiter, ch chan *EntityQueue) error {
+	input := &dynamodb.ScanInput{
+		TableName:              aws.String(x.table.Name()),
+		Segment:                aws.Int64(int64(segment)),
+		TotalSegments:          aws.Int64(int64(x.scanSegments)),
+		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+
+	for {
+		if err := limiter.wait(ctx); err != nil {
+			return err
+		}
+
+		resp, err := x.client.ScanWithContext(ctx, input)
+		if err != nil {
+			return errors.Wrapf(err, "Fail to scan segment %d of DynamoDB", segment)
+		}
+		if resp.ConsumedCapacity != nil {
+			limiter.consume(aws.Float64Value(resp.ConsumedCapacity.CapacityUnits))
+		}
+
+		now := time.Now()
+		q := &EntityQueue{}
+		for _, attrs := range resp.Items {
+			var item dynamoEntityItem
+			if err := dynamo.UnmarshalItem(attrs, &item); err != nil {
+				return errors.Wrapf(err, "Fail to unmarshal item of DynamoDB: %v", attrs)
+			}
+			if entity := item.toEntity(); !entity.Expired(now) {
+				q.Entities = append(q.Entities, &entity)
+			}
+		}
+
+		if len(q.Entities) > 0 {
+			select {
+			case ch <- q:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if len(resp.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// Count counts entities from Iterate because DynamoDB can not count items by group.
+func (x *dynamoRepository) Count(ctx context.Context, filter EntityFilter) (*RepositoryStats, error) {
+	return countEntities(ctx, x.Iterate(ctx, filter))
+}
+
+// Iterate queries SourceIndex if Src of filter and SourceIndex are set. Otherwise entities from parallel Scan of DumpContext are filtered.
+func (x *dynamoRepository) Iterate(ctx context.Context, filter EntityFilter) chan *EntityQueue {
+	if filter.Src == "" || x.sourceIndex == "" {
+		return filterEntities(ctx, x.DumpContext(ctx), filter)
+	}
+
+	ch := make(chan *EntityQueue)
+	go func() {
+		defer close(ch)
+		if err := x.querySource(ctx, filter, ch); err != nil && ctx.Err() == nil {
+			select {
+			case ch <- &EntityQueue{Error: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return ch
+}
+
+// querySource queries entities of filter.Src by SourceIndex and sends entities that match filter by chunk.
+func (x *dynamoRepository) querySource(ctx context.Context, filter EntityFilter, ch chan *EntityQueue) error {
+	query := x.table.Get("src", filter.Src).Index(x.sourceIndex)
+	if filter.Reason != "" {
+		query = query.Filter("'reason' = ?", filter.Reason)
+	}
+
+	send := func(q *EntityQueue) error {
+		select {
+		case ch <- q:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	now := time.Now()
+	q := &EntityQueue{}
+	iter := query.Iter()
+	var item dynamoEntityItem
+	for iter.NextWithContext(ctx, &item) {
+		// saved_at is compared here because string representation of time is not ordered.
+		if entity := item.toEntity(); !entity.Expired(now) && filter.Match(&entity) {
+			q.Entities = append(q.Entities, &entity)
+		}
+		if len(q.Entities) >= dynamoIterateChunkSize {
+			if err := send(q); err != nil {
+				return err
+			}
+			q = &EntityQueue{}
+		}
+		item = dynamoEntityItem{}
+	}
+	if err := iter.Err(); err != nil {
+		return errors.Wrapf(err, "Fail to query entities of %s in DynamoDB", filter.Src)
+	}
+
+	if len(q.Entities) > 0 {
+		return send(q)
+	}
 	return nil
 }
@@ -35,11 +35,13 @@ func serializerCommonTest(t *testing.T, ser badman.Serializer) {
 	entities := []*badman.BadEntity{
 		{
 			Name:    "blue",
+			Kind:    badman.KindDomain,
 			SavedAt: t1,
 			Src:     "tester1",
 		},
 		{
 			Name:    "orange",
+			Kind:    badman.KindIPv4,
 			SavedAt: t2,
 			Src:     "tester1",
 		},
@@ -73,14 +75,17 @@ func serializerCommonTest(t *testing.T, ser badman.Serializer) {
 	}
 
 	assert.Equal(t, "blue", recvEntities[0].Name)
+	assert.Equal(t, badman.KindDomain, recvEntities[0].Kind)
 	assert.Equal(t, "tester1", recvEntities[0].Src)
 	assert.Equal(t, t1.Unix(), recvEntities[0].SavedAt.Unix())
 
 	assert.Equal(t, "orange", recvEntities[1].Name)
+	assert.Equal(t, badman.KindIPv4, recvEntities[1].Kind)
 	assert.Equal(t, "tester1", recvEntities[1].Src)
 	assert.Equal(t, t2.Unix(), recvEntities[1].SavedAt.Unix())
 
 	assert.Equal(t, "red", recvEntities[2].Name)
+	assert.Equal(t, badman.EntityKind(""), recvEntities[2].Kind)
 	assert.Equal(t, "tester1", recvEntities[2].Src)
 	assert.Equal(t, t3.Unix(), recvEntities[2].SavedAt.Unix())
 }
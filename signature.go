@@ -0,0 +1,224 @@
+package badman
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"hash"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// SignatureAlgorithmEd25519 is Algorithm of DumpSignature by ed25519 key.
+	SignatureAlgorithmEd25519 = "ed25519"
+
+	// dumpDigestPrefix is prefix of DumpHeader.Digest to indicate the hash function.
+	dumpDigestPrefix = "sha256:"
+	// dumpSignatureContext is head of signed message not to reuse a signature for other purposes.
+	dumpSignatureContext = "badman-dump-signature-v1\n"
+)
+
+// DumpSignature is ed25519 signature of DumpHeader. DumpHeader has digest of serialized entities, then the signature covers whole dump. It is embedded in DumpHeader or output separately as JSON (detached signature).
+type DumpSignature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	Value     []byte `json:"value"`
+}
+
+// SigningKeyID returns identifier of key to find a trusted key for DumpSignature. It's hex of first 8 bytes of SHA-256 of the key.
+func SigningKeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// dumpSignedMessage returns message to be signed for header: the header JSON as written by writeDumpHeader, which does not include embedded signature. The JSON is not encoded again, then all fields in the data are covered by the signature.
+func dumpSignedMessage(header *DumpHeader) ([]byte, error) {
+	if header.raw == nil {
+		return nil, errors.New("Fail to sign dump header, it is not marshaled")
+	}
+	return append([]byte(dumpSignatureContext), header.raw...), nil
+}
+
+// signDumpHeader creates DumpSignature of header by key.
+func signDumpHeader(header *DumpHeader, key ed25519.PrivateKey) (*DumpSignature, error) {
+	msg, err := dumpSignedMessage(header)
+	if err != nil {
+		return nil, err
+	}
+	return &DumpSignature{
+		Algorithm: SignatureAlgorithmEd25519,
+		KeyID:     SigningKeyID(key.Public().(ed25519.PublicKey)),
+		Value:     ed25519.Sign(key, msg),
+	}, nil
+}
+
+// verifyDumpHeader checks that sig is valid signature of header by one of keys. Embedded signature of header is used if sig is nil.
+func verifyDumpHeader(header *DumpHeader, sig *DumpSignature, keys []ed25519.PublicKey) error {
+	if header == nil {
+		return errors.New("Fail to verify dump, no dump header (unsigned data)")
+	}
+	if sig == nil {
+		sig = header.Signature
+	}
+	if sig == nil {
+		return errors.New("Fail to verify dump, no signature")
+	}
+	if sig.Algorithm != SignatureAlgorithmEd25519 {
+		return errors.Errorf("Fail to verify dump, unsupported signature algorithm: %s", sig.Algorithm)
+	}
+	if header.Digest == "" {
+		return errors.New("Fail to verify dump, no digest in dump header")
+	}
+
+	msg, err := dumpSignedMessage(header)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if SigningKeyID(key) == sig.KeyID && ed25519.Verify(key, msg, sig.Value) {
+			return nil
+		}
+	}
+	return errors.Errorf("Fail to verify dump, invalid signature or untrusted key: %s", sig.KeyID)
+}
+
+// newDumpDigest returns hash function of DumpHeader.Digest.
+func newDumpDigest() hash.Hash {
+	return sha256.New()
+}
+
+// dumpDigest returns DumpHeader.Digest format of h.
+func dumpDigest(h hash.Hash) string {
+	return dumpDigestPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// ReadDumpSignature reads detached signature that is output by DumpDetached.
+func ReadDumpSignature(r io.Reader) (*DumpSignature, error) {
+	var sig DumpSignature
+	if err := json.NewDecoder(r).Decode(&sig); err != nil {
+		return nil, errors.Wrap(err, "Fail to read dump signature")
+	}
+	return &sig, nil
+}
+
+// VerifyDump checks signature and digest of serialized data in r by keys without loading entities. Embedded signature is used if sig is nil. DumpHeader of the data is returned if it's valid.
+func VerifyDump(r io.Reader, sig *DumpSignature, keys ...ed25519.PublicKey) (*DumpHeader, error) {
+	br := bufio.NewReader(r)
+	header, err := readDumpHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDumpHeader(header, sig, keys); err != nil {
+		return nil, err
+	}
+
+	digest := newDumpDigest()
+	if _, err := io.Copy(digest, br); err != nil {
+		return nil, errors.Wrap(err, "Fail to read dump")
+	}
+	if d := dumpDigest(digest); d != header.Digest {
+		return nil, errors.Errorf("Fail to verify dump, digest mismatch: expected %s but %s", header.Digest, d)
+	}
+	return header, nil
+}
+
+// oidEd25519 is algorithm identifier of ed25519 key (RFC 8410).
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// pkcs8Key is PKCS #8 structure of private key. Keys are encoded by encoding/asn1 because crypto/x509 supports ed25519 only in Go 1.13 or later.
+type pkcs8Key struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+	// Optional attributes and public key are omitted.
+}
+
+// pkixPublicKey is SubjectPublicKeyInfo structure of public key.
+type pkixPublicKey struct {
+	Algo      pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// MarshalSigningKey encodes ed25519 private key to PEM (PKCS #8).
+func MarshalSigningKey(key ed25519.PrivateKey) ([]byte, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.Errorf("Fail to marshal signing key, invalid length: %d", len(key))
+	}
+	// PrivateKey of RFC 8410 is OCTET STRING of seed in OCTET STRING.
+	seed, err := asn1.Marshal(key.Seed())
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to marshal signing key")
+	}
+	der, err := asn1.Marshal(pkcs8Key{
+		Algo:       pkix.AlgorithmIdentifier{Algorithm: oidEd25519},
+		PrivateKey: seed,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to marshal signing key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParseSigningKey decodes ed25519 private key from PEM that is encoded by MarshalSigningKey.
+func ParseSigningKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("Fail to parse signing key, no PRIVATE KEY PEM block")
+	}
+	var key pkcs8Key
+	if _, err := asn1.Unmarshal(block.Bytes, &key); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse signing key")
+	}
+	if !key.Algo.Algorithm.Equal(oidEd25519) {
+		return nil, errors.Errorf("Fail to parse signing key, not ed25519 key: %v", key.Algo.Algorithm)
+	}
+	var seed []byte
+	if _, err := asn1.Unmarshal(key.PrivateKey, &seed); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse signing key")
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.Errorf("Fail to parse signing key, invalid seed length: %d", len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// MarshalTrustedKey encodes ed25519 public key to PEM (PKIX).
+func MarshalTrustedKey(key ed25519.PublicKey) ([]byte, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.Errorf("Fail to marshal trusted key, invalid length: %d", len(key))
+	}
+	der, err := asn1.Marshal(pkixPublicKey{
+		Algo:      pkix.AlgorithmIdentifier{Algorithm: oidEd25519},
+		PublicKey: asn1.BitString{Bytes: key, BitLength: 8 * len(key)},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to marshal trusted key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ParseTrustedKey decodes ed25519 public key from PEM that is encoded by MarshalTrustedKey.
+func ParseTrustedKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("Fail to parse trusted key, no PUBLIC KEY PEM block")
+	}
+	var key pkixPublicKey
+	if _, err := asn1.Unmarshal(block.Bytes, &key); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse trusted key")
+	}
+	if !key.Algo.Algorithm.Equal(oidEd25519) {
+		return nil, errors.Errorf("Fail to parse trusted key, not ed25519 key: %v", key.Algo.Algorithm)
+	}
+	if len(key.PublicKey.Bytes) != ed25519.PublicKeySize || key.PublicKey.BitLength != 8*ed25519.PublicKeySize {
+		return nil, errors.Errorf("Fail to parse trusted key, invalid length: %d", key.PublicKey.BitLength)
+	}
+	return ed25519.PublicKey(key.PublicKey.Bytes), nil
+}
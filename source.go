@@ -1,6 +1,28 @@
 package badman
 
+import "context"
+
 // Source is interface of BlackList.
 type Source interface {
 	Download() chan *EntityQueue
 }
+
+// SourceContext is Source that supports cancellation by context.Context. DownloadContext should close the channel and stop HTTP request when ctx is done. BadMan uses DownloadContext if a source implements it.
+type SourceContext interface {
+	Source
+	DownloadContext(ctx context.Context) chan *EntityQueue
+}
+
+// SourceWithSrc is Source that declares Src of entities that it downloads. Sync mode of Download does not prune a Src that a failed source declares, even if the source failed before sending any entity. It matters when sources share Src (e.g. URLhausRecent and URLhausOnline).
+type SourceWithSrc interface {
+	Source
+	Srcs() []string
+}
+
+// download starts download from src with ctx if src implements SourceContext.
+func download(ctx context.Context, src Source) chan *EntityQueue {
+	if s, ok := src.(SourceContext); ok {
+		return s.DownloadContext(ctx)
+	}
+	return src.Download()
+}
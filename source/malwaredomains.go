@@ -2,6 +2,7 @@ package source
 
 import (
 	"bufio"
+	"context"
 	"strings"
 	"time"
 
@@ -11,6 +12,8 @@ import (
 // MalwareDomains downloads blacklist from http://www.malwaredomains.com/
 type MalwareDomains struct {
 	URL string
+	// TTL is lifetime of downloaded entities. Entities never expire if TTL is zero.
+	TTL time.Duration
 }
 
 // NewMalwareDomains is constructor of MalwareDomains
@@ -22,6 +25,16 @@ func NewMalwareDomains() *MalwareDomains {
 
 // Download of MalwareDomains downloads domains.txt and parses to extract domain names.
 func (x *MalwareDomains) Download() chan *badman.EntityQueue {
+	return x.DownloadContext(context.Background())
+}
+
+// Srcs of MalwareDomains returns Src of entities that MalwareDomains downloads.
+func (x *MalwareDomains) Srcs() []string {
+	return []string{srcMalwareDomains}
+}
+
+// DownloadContext of MalwareDomains is same with Download, but it can be cancelled by ctx.
+func (x *MalwareDomains) DownloadContext(ctx context.Context) chan *badman.EntityQueue {
 	ch := make(chan *badman.EntityQueue, defaultSourceChanSize)
 	bufferSize := 128
 
@@ -30,10 +43,11 @@ func (x *MalwareDomains) Download() chan *badman.EntityQueue {
 		buffer := []*badman.BadEntity{}
 
 		now := time.Now()
-		body := getHTTPBody(x.URL, ch)
+		body := getHTTPBody(ctx, x.URL, ch)
 		if body == nil {
 			return
 		}
+		defer body.Close()
 
 		scanner := bufio.NewScanner(body)
 		for scanner.Scan() {
@@ -43,22 +57,30 @@ func (x *MalwareDomains) Download() chan *badman.EntityQueue {
 			}
 
 			row := strings.Split(line, "\t")
+			if len(row) < 4 {
+				continue
+			}
 
 			buffer = append(buffer, &badman.BadEntity{
 				Name:    row[2],
+				Kind:    badman.KindDomain,
 				SavedAt: now,
-				Src:     "MalwareDomains",
+				Src:     srcMalwareDomains,
 				Reason:  row[3],
+
+				ExpiresAt: expiresAt(now, x.TTL),
 			})
 
 			if len(buffer) >= bufferSize {
-				ch <- &badman.EntityQueue{Entities: buffer}
+				if !sendQueue(ctx, ch, &badman.EntityQueue{Entities: buffer}) {
+					return
+				}
 				buffer = []*badman.BadEntity{}
 			}
 		}
 
 		if len(buffer) > 0 {
-			ch <- &badman.EntityQueue{Entities: buffer}
+			sendQueue(ctx, ch, &badman.EntityQueue{Entities: buffer})
 		}
 	}()
 
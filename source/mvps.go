@@ -2,6 +2,7 @@ package source
 
 import (
 	"bufio"
+	"context"
 	"strings"
 	"time"
 
@@ -11,6 +12,8 @@ import (
 // MVPS downloads blacklist from http://winhelp2002.mvps.org/hosts.txt
 type MVPS struct {
 	URL string
+	// TTL is lifetime of downloaded entities. Entities never expire if TTL is zero.
+	TTL time.Duration
 }
 
 // NewMVPS is constructor of MVPS
@@ -22,6 +25,16 @@ func NewMVPS() *MVPS {
 
 // Download of MVPS downloads domains.txt and parses to extract domain names.
 func (x *MVPS) Download() chan *badman.EntityQueue {
+	return x.DownloadContext(context.Background())
+}
+
+// Srcs of MVPS returns Src of entities that MVPS downloads.
+func (x *MVPS) Srcs() []string {
+	return []string{srcMVPS}
+}
+
+// DownloadContext of MVPS is same with Download, but it can be cancelled by ctx.
+func (x *MVPS) DownloadContext(ctx context.Context) chan *badman.EntityQueue {
 	ch := make(chan *badman.EntityQueue, defaultSourceChanSize)
 	bufferSize := 128
 
@@ -30,10 +43,11 @@ func (x *MVPS) Download() chan *badman.EntityQueue {
 		buffer := []*badman.BadEntity{}
 
 		now := time.Now()
-		body := getHTTPBody(x.URL, ch)
+		body := getHTTPBody(ctx, x.URL, ch)
 		if body == nil {
 			return
 		}
+		defer body.Close()
 
 		scanner := bufio.NewScanner(body)
 		for scanner.Scan() {
@@ -43,19 +57,24 @@ func (x *MVPS) Download() chan *badman.EntityQueue {
 			if len(row) == 2 && row[0] == "0.0.0.0" {
 				buffer = append(buffer, &badman.BadEntity{
 					Name:    row[1],
+					Kind:    badman.KindDomain,
 					SavedAt: now,
-					Src:     "MVPs",
+					Src:     srcMVPS,
+
+					ExpiresAt: expiresAt(now, x.TTL),
 				})
 
 				if len(buffer) >= bufferSize {
-					ch <- &badman.EntityQueue{Entities: buffer}
+					if !sendQueue(ctx, ch, &badman.EntityQueue{Entities: buffer}) {
+						return
+					}
 					buffer = []*badman.BadEntity{}
 				}
 			}
 		}
 
 		if len(buffer) > 0 {
-			ch <- &badman.EntityQueue{Entities: buffer}
+			sendQueue(ctx, ch, &badman.EntityQueue{Entities: buffer})
 		}
 	}()
 
@@ -1,8 +1,10 @@
 package source
 
 import (
+	"context"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/m-mizutani/badman"
 	"github.com/pkg/errors"
@@ -18,6 +20,13 @@ var DefaultSet = []badman.Source{
 
 const defaultSourceChanSize = 128
 
+// Src of entities downloaded by sources.
+const (
+	srcMVPS           = "MVPs"
+	srcMalwareDomains = "MalwareDomains"
+	srcURLhaus        = "URLhaus"
+)
+
 // httpClient interface is used to inject own client for testing.
 // InjectNewHTTPClient in export_test.go replace constructor to use
 // dummy HTTP client and FixNewHTTPClient in export_test.go reverts it.
@@ -29,29 +38,49 @@ func newNormalHTTPClient() httpClient { return &http.Client{} }
 
 var newHTTPClient = newNormalHTTPClient
 
-func getHTTPBody(url string, ch chan *badman.EntityQueue) io.Reader {
+// getHTTPBody sends GET request to url and returns body of the response. The request is cancelled when ctx is done. If an error occurs, it's sent to ch and nil is returned. Caller must close the returned body.
+func getHTTPBody(ctx context.Context, url string, ch chan *badman.EntityQueue) io.ReadCloser {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		ch <- &badman.EntityQueue{
+		sendQueue(ctx, ch, &badman.EntityQueue{
 			Error: errors.Wrapf(err, "Fail to craete new MalwareDomains HTTP request to: %s", url),
-		}
+		})
 		return nil
 	}
 
 	client := newHTTPClient()
-	resp, err := client.Do(req)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		ch <- &badman.EntityQueue{
+		sendQueue(ctx, ch, &badman.EntityQueue{
 			Error: errors.Wrapf(err, "Fail to send HTTP request to: %s", url),
-		}
+		})
 		return nil
 	}
 	if resp.StatusCode != 200 {
-		ch <- &badman.EntityQueue{
-			Error: errors.Wrapf(err, "Unexpected status code (%d): %s", resp.StatusCode, url),
-		}
+		resp.Body.Close()
+		sendQueue(ctx, ch, &badman.EntityQueue{
+			Error: errors.Errorf("Unexpected status code (%d): %s", resp.StatusCode, url),
+		})
 		return nil
 	}
 
 	return resp.Body
 }
+
+// sendQueue sends q to ch. It returns false if ctx is done before sending.
+func sendQueue(ctx context.Context, ch chan *badman.EntityQueue, q *badman.EntityQueue) bool {
+	select {
+	case ch <- q:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// expiresAt returns expiration time of entities that are downloaded at now. Zero time (never expire) is returned if ttl is not positive.
+func expiresAt(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
@@ -1,9 +1,12 @@
 package source_test
 
 import (
+	"context"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/m-mizutani/badman"
 	"github.com/m-mizutani/badman/source"
@@ -44,10 +47,12 @@ func TestMalwareDomains(t *testing.T) {
 
 	assert.Equal(t, 2, len(entities))
 	assert.Equal(t, "blue.example.com", entities[0].Name)
+	assert.Equal(t, badman.KindDomain, entities[0].Kind)
 	assert.Equal(t, "MalwareDomains", entities[0].Src)
 	assert.Equal(t, "phishing", entities[0].Reason)
 
 	assert.Equal(t, "orange.example.net", entities[1].Name)
+	assert.Equal(t, badman.KindDomain, entities[1].Kind)
 	assert.Equal(t, "MalwareDomains", entities[1].Src)
 	assert.Equal(t, "exploit", entities[1].Reason)
 }
@@ -73,10 +78,12 @@ func TestMVPs(t *testing.T) {
 
 	assert.Equal(t, 2, len(entities))
 	assert.Equal(t, "blue.example.com", entities[0].Name)
+	assert.Equal(t, badman.KindDomain, entities[0].Kind)
 	assert.Equal(t, "MVPs", entities[0].Src)
 	assert.Equal(t, "", entities[0].Reason)
 
 	assert.Equal(t, "orange.example.net", entities[1].Name)
+	assert.Equal(t, badman.KindDomain, entities[1].Kind)
 	assert.Equal(t, "MVPs", entities[1].Src)
 	assert.Equal(t, "", entities[1].Reason)
 }
@@ -104,10 +111,12 @@ func TestURLhausRecent(t *testing.T) {
 
 	assert.Equal(t, 2, len(entities))
 	assert.Equal(t, "blue.example.com", entities[0].Name)
+	assert.Equal(t, badman.KindDomain, entities[0].Kind)
 	assert.Equal(t, "URLhaus", entities[0].Src)
 	assert.Equal(t, "malware_download", entities[0].Reason)
 
 	assert.Equal(t, "orange.example.net", entities[1].Name)
+	assert.Equal(t, badman.KindDomain, entities[1].Kind)
 	assert.Equal(t, "URLhaus", entities[1].Src)
 	assert.Equal(t, "malware_download", entities[1].Reason)
 }
@@ -135,10 +144,80 @@ func TestURLhausOnline(t *testing.T) {
 
 	assert.Equal(t, 2, len(entities))
 	assert.Equal(t, "blue.example.com", entities[0].Name)
+	assert.Equal(t, badman.KindDomain, entities[0].Kind)
 	assert.Equal(t, "URLhaus", entities[0].Src)
 	assert.Equal(t, "malware_download", entities[0].Reason)
 
 	assert.Equal(t, "orange.example.net", entities[1].Name)
+	assert.Equal(t, badman.KindDomain, entities[1].Kind)
 	assert.Equal(t, "URLhaus", entities[1].Src)
 	assert.Equal(t, "malware_download", entities[1].Reason)
 }
+
+func TestSourceTTL(t *testing.T) {
+	fd, err := os.Open("test/mvps/hosts.txt")
+	require.NoError(t, err)
+	dummy := &dummyHTTPClient{
+		Resp: &http.Response{
+			StatusCode: 200,
+			Body:       fd,
+		},
+	}
+
+	source.InjectNewHTTPClient(dummy)
+	defer source.FixNewHTTPClient()
+
+	src := source.NewMVPS()
+	src.TTL = time.Hour
+
+	var entities []*badman.BadEntity
+	for q := range src.Download() {
+		require.NoError(t, q.Error)
+		entities = append(entities, q.Entities...)
+	}
+
+	require.Equal(t, 2, len(entities))
+	assert.Equal(t, entities[0].SavedAt.Add(time.Hour), entities[0].ExpiresAt)
+	assert.False(t, entities[0].Expired(time.Now()))
+	assert.True(t, entities[0].Expired(time.Now().Add(2*time.Hour)))
+}
+
+func TestDownloadContextCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	src := source.NewURLhausOnline()
+	src.URL = server.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := src.DownloadContext(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timer.C:
+			require.Fail(t, "DownloadContext did not stop after cancel")
+		}
+	}
+}
+
+func TestSourceSrcs(t *testing.T) {
+	for _, src := range source.DefaultSet {
+		s, ok := src.(badman.SourceWithSrc)
+		require.True(t, ok, "%T", src)
+		assert.Equal(t, 1, len(s.Srcs()))
+	}
+
+	assert.Equal(t, source.NewURLhausRecent().Srcs(), source.NewURLhausOnline().Srcs())
+}
@@ -1,6 +1,7 @@
 package source
 
 import (
+	"context"
 	"encoding/csv"
 	"io"
 	"net/url"
@@ -10,21 +11,23 @@ import (
 	"github.com/pkg/errors"
 )
 
-func downloadURLhasu(csvURL string, ch chan *badman.EntityQueue) {
+func downloadURLhasu(ctx context.Context, csvURL string, ttl time.Duration, ch chan *badman.EntityQueue) {
 	defer close(ch)
+	now := time.Now()
 	bufferSize := 128
 	buffer := []*badman.BadEntity{}
 
 	defer func() {
 		if len(buffer) > 0 {
-			ch <- &badman.EntityQueue{Entities: buffer}
+			sendQueue(ctx, ch, &badman.EntityQueue{Entities: buffer})
 		}
 	}()
 
-	body := getHTTPBody(csvURL, ch)
+	body := getHTTPBody(ctx, csvURL, ch)
 	if body == nil {
 		return
 	}
+	defer body.Close()
 
 	reader := csv.NewReader(body)
 	reader.Comment = []rune("#")[0]
@@ -34,9 +37,9 @@ func downloadURLhasu(csvURL string, ch chan *badman.EntityQueue) {
 		if err == io.EOF {
 			return
 		} else if err != nil {
-			ch <- &badman.EntityQueue{
+			sendQueue(ctx, ch, &badman.EntityQueue{
 				Error: errors.Wrapf(err, "Fail to read CSV of URLhaus"),
-			}
+			})
 			return
 		}
 
@@ -46,29 +49,35 @@ func downloadURLhasu(csvURL string, ch chan *badman.EntityQueue) {
 
 		url, err := url.Parse(row[2])
 		if err != nil {
-			ch <- &badman.EntityQueue{
+			sendQueue(ctx, ch, &badman.EntityQueue{
 				Error: errors.Wrapf(err, "Fail to parse URL in URLhaus CSV"),
-			}
+			})
 			return
 		}
 
 		ts, err := time.Parse("2006-01-02 15:04:05", row[1])
 		if err != nil {
-			ch <- &badman.EntityQueue{
+			sendQueue(ctx, ch, &badman.EntityQueue{
 				Error: errors.Wrapf(err, "Fail to parse tiemstamp in URLhaus CSV"),
-			}
+			})
 			return
 		}
 
 		buffer = append(buffer, &badman.BadEntity{
 			Name:    url.Hostname(),
+			Kind:    badman.ClassifyName(url.Hostname()),
 			SavedAt: ts,
-			Src:     "URLhaus",
+			Src:     srcURLhaus,
 			Reason:  row[4],
+
+			ExpiresAt: expiresAt(now, ttl),
 		})
 
 		if len(buffer) >= bufferSize {
-			ch <- &badman.EntityQueue{Entities: buffer}
+			if !sendQueue(ctx, ch, &badman.EntityQueue{Entities: buffer}) {
+				buffer = nil
+				return
+			}
 			buffer = []*badman.BadEntity{}
 		}
 	}
@@ -78,6 +87,8 @@ func downloadURLhasu(csvURL string, ch chan *badman.EntityQueue) {
 // The blacklist has only URLs in recent 30 days.
 type URLhausRecent struct {
 	URL string
+	// TTL is lifetime of downloaded entities. Entities never expire if TTL is zero.
+	TTL time.Duration
 }
 
 // NewURLhausRecent is constructor of URLhausRecent
@@ -89,8 +100,18 @@ func NewURLhausRecent() *URLhausRecent {
 
 // Download of URLhausRecent downloads domains.txt and parses to extract domain names.
 func (x *URLhausRecent) Download() chan *badman.EntityQueue {
+	return x.DownloadContext(context.Background())
+}
+
+// Srcs of URLhausRecent returns Src of entities that URLhausRecent downloads. It's shared with URLhausOnline.
+func (x *URLhausRecent) Srcs() []string {
+	return []string{srcURLhaus}
+}
+
+// DownloadContext of URLhausRecent is same with Download, but it can be cancelled by ctx.
+func (x *URLhausRecent) DownloadContext(ctx context.Context) chan *badman.EntityQueue {
 	ch := make(chan *badman.EntityQueue, defaultSourceChanSize)
-	go downloadURLhasu(x.URL, ch)
+	go downloadURLhasu(ctx, x.URL, x.TTL, ch)
 	return ch
 }
 
@@ -98,6 +119,8 @@ func (x *URLhausRecent) Download() chan *badman.EntityQueue {
 // The blacklist has only online URLs.
 type URLhausOnline struct {
 	URL string
+	// TTL is lifetime of downloaded entities. Entities never expire if TTL is zero.
+	TTL time.Duration
 }
 
 // NewURLhausOnline is constructor of URLhausOnline
@@ -109,7 +132,17 @@ func NewURLhausOnline() *URLhausOnline {
 
 // Download of URLhausOnline downloads domains.txt and parses to extract domain names.
 func (x *URLhausOnline) Download() chan *badman.EntityQueue {
+	return x.DownloadContext(context.Background())
+}
+
+// Srcs of URLhausOnline returns Src of entities that URLhausOnline downloads. It's shared with URLhausRecent.
+func (x *URLhausOnline) Srcs() []string {
+	return []string{srcURLhaus}
+}
+
+// DownloadContext of URLhausOnline is same with Download, but it can be cancelled by ctx.
+func (x *URLhausOnline) DownloadContext(ctx context.Context) chan *badman.EntityQueue {
 	ch := make(chan *badman.EntityQueue, defaultSourceChanSize)
-	go downloadURLhasu(x.URL, ch)
+	go downloadURLhasu(ctx, x.URL, x.TTL, ch)
 	return ch
 }
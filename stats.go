@@ -0,0 +1,179 @@
+package badman
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// EntityFilter specifies entities to be counted and iterated. Zero value matches all entities. Conditions are combined by AND.
+type EntityFilter struct {
+	// Src matches entities of the source if it's not empty.
+	Src string
+	// Reason matches entities that have exactly same Reason if it's not empty.
+	Reason string
+	// SavedAfter and SavedBefore match entities that SavedAt is in [SavedAfter, SavedBefore). Zero value means no limit.
+	SavedAfter  time.Time
+	SavedBefore time.Time
+}
+
+// Match returns true if entity satisfies all conditions of the filter.
+func (x EntityFilter) Match(entity *BadEntity) bool {
+	if x.Src != "" && entity.Src != x.Src {
+		return false
+	}
+	if x.Reason != "" && entity.Reason != x.Reason {
+		return false
+	}
+	if !x.SavedAfter.IsZero() && entity.SavedAt.Before(x.SavedAfter) {
+		return false
+	}
+	if !x.SavedBefore.IsZero() && !entity.SavedAt.Before(x.SavedBefore) {
+		return false
+	}
+	return true
+}
+
+// RepositoryStats is number of entities in repository. An entity is counted for each pair of Name and Src.
+type RepositoryStats struct {
+	Total   int
+	Sources map[string]int
+	Kinds   map[EntityKind]int
+}
+
+func newRepositoryStats() *RepositoryStats {
+	return &RepositoryStats{
+		Sources: make(map[string]int),
+		Kinds:   make(map[EntityKind]int),
+	}
+}
+
+func (x *RepositoryStats) add(entity *BadEntity) {
+	x.Total++
+	x.Sources[entity.Src]++
+	x.Kinds[entity.Kind]++
+}
+
+// StatsRepository is Repository that can count and iterate entities by EntityFilter efficiently. BadMan uses methods of StatsRepository if a repository implements it, otherwise scans all entities by Dump. Expired entities are neither counted nor iterated.
+type StatsRepository interface {
+	Count(ctx context.Context, filter EntityFilter) (*RepositoryStats, error)
+	Iterate(ctx context.Context, filter EntityFilter) chan *EntityQueue
+}
+
+// withStats returns repo as StatsRepository. If repo does not implement StatsRepository, entities from Dump are filtered.
+func withStats(repo Repository) StatsRepository {
+	if s, ok := repo.(StatsRepository); ok {
+		return s
+	}
+	return &dumpStatsAdapter{repo: withContext(repo)}
+}
+
+type dumpStatsAdapter struct {
+	repo RepositoryContext
+}
+
+func (x *dumpStatsAdapter) Count(ctx context.Context, filter EntityFilter) (*RepositoryStats, error) {
+	return countEntities(ctx, x.Iterate(ctx, filter))
+}
+
+func (x *dumpStatsAdapter) Iterate(ctx context.Context, filter EntityFilter) chan *EntityQueue {
+	ch := x.repo.DumpContext(ctx)
+	if ch == nil {
+		return nil
+	}
+	return filterEntities(ctx, ch, filter)
+}
+
+// countEntities counts entities from ch.
+func countEntities(ctx context.Context, ch chan *EntityQueue) (*RepositoryStats, error) {
+	if ch == nil {
+		return nil, fmt.Errorf("This repository does not support Dump()")
+	}
+
+	stats := newRepositoryStats()
+	for q := range ch {
+		if q.Error != nil {
+			return nil, q.Error
+		}
+		for _, entity := range q.Entities {
+			stats.add(entity)
+		}
+	}
+
+	// Dump completes normally when the channel is closed by cancellation.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// filterEntities passes only entities that match filter from ch to returned channel until ctx is done. ch is drained after ctx is done to release the sender.
+func filterEntities(ctx context.Context, ch chan *EntityQueue, filter EntityFilter) chan *EntityQueue {
+	filtered := make(chan *EntityQueue)
+	go func() {
+		defer close(filtered)
+		for q := range ch {
+			if q.Error == nil {
+				var entities []*BadEntity
+				for _, entity := range q.Entities {
+					if filter.Match(entity) {
+						entities = append(entities, entity)
+					}
+				}
+				if len(entities) == 0 {
+					continue
+				}
+				q = &EntityQueue{Entities: entities}
+			}
+
+			select {
+			case filtered <- q:
+			case <-ctx.Done():
+				for range ch {
+				}
+				return
+			}
+		}
+	}()
+	return filtered
+}
+
+// Count returns number of entities that match filter in total, by source and by kind.
+func (x *BadMan) Count(filter EntityFilter) (*RepositoryStats, error) {
+	return x.CountContext(context.Background(), filter)
+}
+
+// CountContext is same with Count, but it can be cancelled by ctx.
+func (x *BadMan) CountContext(ctx context.Context, filter EntityFilter) (*RepositoryStats, error) {
+	return withStats(x.repository()).Count(ctx, filter)
+}
+
+// Iterate calls fn with each entity that matches filter. Order of entities depends on repository. Iteration stops and the error is returned if fn returns error.
+func (x *BadMan) Iterate(filter EntityFilter, fn func(entity BadEntity) error) error {
+	return x.IterateContext(context.Background(), filter, fn)
+}
+
+// IterateContext is same with Iterate, but it can be cancelled by ctx.
+func (x *BadMan) IterateContext(ctx context.Context, filter EntityFilter, fn func(entity BadEntity) error) error {
+	// Stop Iterate of repository when fn fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := withStats(x.repository()).Iterate(ctx, filter)
+	if ch == nil {
+		return fmt.Errorf("This repository does not support Dump()")
+	}
+
+	for q := range ch {
+		if q.Error != nil {
+			return q.Error
+		}
+		for _, entity := range q.Entities {
+			if err := fn(*entity); err != nil {
+				return err
+			}
+		}
+	}
+
+	return ctx.Err()
+}
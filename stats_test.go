@@ -0,0 +1,103 @@
+package badman_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/badman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// insertStatsTestEntities inserts entities via BadMan to set Kind.
+func insertStatsTestEntities(t *testing.T, man *badman.BadMan, base time.Time) {
+	for _, entity := range []badman.BadEntity{
+		{Name: "blue.example.com", SavedAt: base, Src: "alpha", Reason: "malware"},
+		{Name: "blue.example.com", SavedAt: base.Add(time.Hour), Src: "beta", Reason: "phishing"},
+		{Name: "orange.example.com", SavedAt: base.Add(2 * time.Hour), Src: "alpha", Reason: "phishing"},
+		{Name: "192.0.2.1", SavedAt: base.Add(3 * time.Hour), Src: "alpha", Reason: "malware"},
+		{Name: "192.0.2.0/24", SavedAt: base.Add(4 * time.Hour), Src: "beta", Reason: "malware"},
+		{Name: "expired.example.com", SavedAt: base, Src: "alpha", ExpiresAt: time.Now().Add(-time.Minute)},
+	} {
+		require.NoError(t, man.Insert(entity))
+	}
+}
+
+func statsTest(t *testing.T, repo badman.Repository) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	man := badman.New()
+	man.ReplaceRepository(repo)
+	insertStatsTestEntities(t, man, base)
+
+	stats, err := man.Count(badman.EntityFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, 5, stats.Total)
+	assert.Equal(t, map[string]int{"alpha": 3, "beta": 2}, stats.Sources)
+	assert.Equal(t, map[badman.EntityKind]int{
+		badman.KindDomain: 3,
+		badman.KindIPv4:   1,
+		badman.KindCIDR:   1,
+	}, stats.Kinds)
+
+	stats, err = man.Count(badman.EntityFilter{Src: "alpha", Reason: "malware"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Total)
+
+	var names []string
+	err = man.Iterate(badman.EntityFilter{
+		SavedAfter:  base.Add(time.Hour),
+		SavedBefore: base.Add(3 * time.Hour),
+	}, func(entity badman.BadEntity) error {
+		names = append(names, entity.Name+"/"+entity.Src)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"blue.example.com/beta", "orange.example.com/alpha"}, names)
+
+	names = nil
+	err = man.Iterate(badman.EntityFilter{Src: "beta"}, func(entity badman.BadEntity) error {
+		names = append(names, entity.Name)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"blue.example.com", "192.0.2.0/24"}, names)
+
+	// Iteration stops by error of callback.
+	stop := errors.New("stop")
+	var n int
+	err = man.Iterate(badman.EntityFilter{}, func(entity badman.BadEntity) error {
+		n++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestInMemoryRepositoryStats(t *testing.T) {
+	statsTest(t, badman.NewInMemoryRepository())
+}
+
+func TestBoltRepositoryStats(t *testing.T) {
+	// boltRepository does not implement StatsRepository, then entities of Dump are counted.
+	repo, cleanup := newBoltRepository(t)
+	defer cleanup()
+	statsTest(t, repo)
+}
+
+func TestCachedRepositoryEnumeration(t *testing.T) {
+	statsTest(t, badman.NewCachedRepository(badman.NewInMemoryRepository(), badman.CacheConfig{}))
+}
+
+func TestEntityFilter(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	entity := &badman.BadEntity{Name: "blue.example.com", SavedAt: base, Src: "alpha", Reason: "malware"}
+
+	assert.True(t, badman.EntityFilter{}.Match(entity))
+	assert.True(t, badman.EntityFilter{Src: "alpha", Reason: "malware"}.Match(entity))
+	assert.False(t, badman.EntityFilter{Src: "beta"}.Match(entity))
+	assert.False(t, badman.EntityFilter{Reason: "phishing"}.Match(entity))
+	assert.True(t, badman.EntityFilter{SavedAfter: base, SavedBefore: base.Add(time.Second)}.Match(entity))
+	assert.False(t, badman.EntityFilter{SavedAfter: base.Add(time.Second)}.Match(entity))
+	assert.False(t, badman.EntityFilter{SavedBefore: base}.Match(entity))
+}